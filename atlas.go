@@ -0,0 +1,167 @@
+package traas2
+
+import (
+	"math"
+	"strconv"
+)
+
+// AtlasFirmware is the probe firmware version reported in Atlas results.
+// Parsers of Atlas results select the result format by firmware version,
+// and this is the version whose traceroute format is produced.
+const AtlasFirmware = 5020
+
+// icmpDestinationUnreachable is the ICMP type of hops that report an error.
+const icmpDestinationUnreachable = 3
+
+// atlasUnreachable maps destination unreachable codes to Atlas error flags.
+var atlasUnreachable = map[uint8]string{
+	0:  "N",
+	1:  "H",
+	2:  "P",
+	3:  "p",
+	13: "A",
+}
+
+// AtlasResult is a traceroute result in the RIPE Atlas result format.
+type AtlasResult struct {
+	Firmware  int        `json:"fw"`
+	AF        int        `json:"af"`
+	DstAddr   string     `json:"dst_addr"`
+	DstName   string     `json:"dst_name"`
+	EndTime   int64      `json:"endtime"`
+	From      string     `json:"from"`
+	MsmID     int        `json:"msm_id"`
+	MsmName   string     `json:"msm_name"`
+	ParisID   int        `json:"paris_id"`
+	PrbID     int        `json:"prb_id"`
+	Proto     string     `json:"proto"`
+	Result    []AtlasHop `json:"result"`
+	Size      int        `json:"size"`
+	SrcAddr   string     `json:"src_addr"`
+	Timestamp int64      `json:"timestamp"`
+	Type      string     `json:"type"`
+	Traas     string     `json:"traas_id,omitempty"`
+}
+
+// AtlasHop is the set of replies at a single TTL of an Atlas traceroute.
+type AtlasHop struct {
+	Hop    int          `json:"hop"`
+	Result []AtlasReply `json:"result"`
+}
+
+// AtlasReply is a single reply, or timeout, of an Atlas traceroute hop.
+type AtlasReply struct {
+	From    string        `json:"from,omitempty"`
+	RTT     float64       `json:"rtt,omitempty"`
+	TTL     int           `json:"ttl,omitempty"`
+	Err     string        `json:"err,omitempty"`
+	ICMPExt *AtlasICMPExt `json:"icmpext,omitempty"`
+	X       string        `json:"x,omitempty"`
+}
+
+// AtlasICMPExt is the ICMP extension structure of an Atlas reply.
+type AtlasICMPExt struct {
+	Version int               `json:"version"`
+	RFC4884 int               `json:"rfc4884"`
+	Obj     []AtlasICMPExtObj `json:"obj"`
+}
+
+// AtlasICMPExtObj is an ICMP extension object of an Atlas reply.
+type AtlasICMPExtObj struct {
+	Class int         `json:"class"`
+	Type  int         `json:"type"`
+	MPLS  []AtlasMPLS `json:"mpls,omitempty"`
+}
+
+// AtlasMPLS is an MPLS label stack entry of an Atlas reply.
+type AtlasMPLS struct {
+	Exp   int    `json:"exp"`
+	Label uint32 `json:"label"`
+	S     int    `json:"s"`
+	TTL   int    `json:"ttl"`
+}
+
+// Atlas converts a trace to a RIPE Atlas traceroute result. The trace is
+// of the reverse path, so the server is the source and the client is the
+// destination. TTLs between the first and last replies that went
+// unanswered are reported as timeouts.
+func (t *Trace) Atlas() AtlasResult {
+	r := AtlasResult{
+		Firmware:  AtlasFirmware,
+		AF:        4,
+		DstAddr:   t.To.String(),
+		DstName:   t.To.String(),
+		EndTime:   t.Started.Unix(),
+		MsmName:   "Traceroute",
+		Proto:     "TCP",
+		Result:    make([]AtlasHop, 0, len(t.Route)),
+		Timestamp: t.Started.Unix(),
+		Type:      "traceroute",
+		Traas:     t.ID,
+	}
+	if t.To.To4() == nil {
+		r.AF = 6
+	}
+	if t.From != nil {
+		r.From = t.From.String()
+		r.SrcAddr = t.From.String()
+	}
+
+	// hops of traces recorded elsewhere may be closer than those probed by traas.
+	first := TraceShortestTTL
+	for _, h := range t.Route {
+		if int(h.TTL) < first {
+			first = int(h.TTL)
+		}
+	}
+	next := 0
+	for ttl := first; next < len(t.Route); ttl++ {
+		hop := AtlasHop{Hop: ttl}
+		for ; next < len(t.Route) && int(t.Route[next].TTL) == ttl; next++ {
+			hop.Result = append(hop.Result, t.Route[next].atlasReply())
+			if end := t.Route[next].Received.Unix(); end > r.EndTime {
+				r.EndTime = end
+			}
+		}
+		for next < len(t.Route) && int(t.Route[next].TTL) < ttl {
+			next++
+		}
+		if len(hop.Result) == 0 {
+			hop.Result = []AtlasReply{{X: "*"}}
+		}
+		r.Result = append(r.Result, hop)
+	}
+	return r
+}
+
+// atlasReply converts a recorded hop to an Atlas reply.
+func (h Hop) atlasReply() AtlasReply {
+	reply := AtlasReply{
+		From: h.IP.String(),
+		RTT:  math.Round(millis(h.RTT())*1000) / 1000,
+		TTL:  int(h.ReplyTTL),
+	}
+	if h.ICMPType == icmpDestinationUnreachable {
+		if flag, ok := atlasUnreachable[h.ICMPCode]; ok {
+			reply.Err = flag
+		} else {
+			reply.Err = strconv.Itoa(int(h.ICMPCode))
+		}
+	}
+	if len(h.Extensions) > 0 {
+		ext := &AtlasICMPExt{Version: 2, RFC4884: 1}
+		for _, e := range h.Extensions {
+			obj := AtlasICMPExtObj{Class: int(e.Class), Type: int(e.Type)}
+			for _, l := range e.MPLS {
+				s := 0
+				if l.S {
+					s = 1
+				}
+				obj.MPLS = append(obj.MPLS, AtlasMPLS{Exp: int(l.Exp), Label: l.Label, S: s, TTL: int(l.TTL)})
+			}
+			ext.Obj = append(ext.Obj, obj)
+		}
+		reply.ICMPExt = ext
+	}
+	return reply
+}
@@ -0,0 +1,80 @@
+package traas2
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseICMPExtensions(t *testing.T) {
+	payload := make([]byte, icmpOriginalDatagramMin)
+	// Extension header, version 2, then an MPLS stack object with one entry
+	payload = append(payload, 0x20, 0, 0, 0)
+	payload = append(payload, 0, 8, ICMPExtensionClassMPLS, 1)
+	// label 16000, exp 2, bottom of stack, ttl 1
+	payload = append(payload, 0x03, 0xE8, 0x05, 0x01)
+
+	exts := ParseICMPExtensions(payload, icmpOriginalDatagramMin/4)
+	if len(exts) != 1 || len(exts[0].MPLS) != 1 {
+		t.Fatalf("Expected one MPLS extension, got %+v", exts)
+	}
+	if l := exts[0].MPLS[0]; l.Label != 16000 || l.Exp != 2 || !l.S || l.TTL != 1 {
+		t.Fatalf("Unexpected MPLS entry %+v", l)
+	}
+	if ParseICMPExtensions(payload[:64], 16) != nil {
+		t.Fatal("Short datagrams should not have extensions")
+	}
+}
+
+func TestAtlas(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	trace := &Trace{
+		ID:      "abc",
+		From:    net.ParseIP("192.0.2.1"),
+		To:      net.ParseIP("10.0.0.1"),
+		Started: start,
+		Route: Route{
+			{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond, ICMPType: 11, ReplyTTL: 252,
+				Received:   start.Add(time.Second),
+				Extensions: []ICMPExtension{{Class: 1, Type: 1, MPLS: []MPLSLabel{{Label: 16000, S: true, TTL: 1}}}}},
+			{TTL: 6, IP: net.ParseIP("10.0.0.1"), Latency: time.Millisecond, ICMPType: 3, ICMPCode: 13,
+				Received: start.Add(2 * time.Second)},
+		},
+	}
+	r := trace.Atlas()
+	if r.SrcAddr != "192.0.2.1" || r.DstAddr != "10.0.0.1" || r.AF != 4 || r.EndTime != start.Unix()+2 {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+	if len(r.Result) != 3 || r.Result[1].Hop != 5 || r.Result[1].Result[0].X != "*" {
+		t.Fatalf("Expected a timeout at ttl 5, got %+v", r.Result)
+	}
+	first := r.Result[0].Result[0]
+	if first.RTT != 2 || first.TTL != 252 || first.ICMPExt == nil || first.ICMPExt.Obj[0].MPLS[0].S != 1 {
+		t.Fatalf("Unexpected reply %+v", first)
+	}
+	if r.Result[2].Result[0].Err != "A" {
+		t.Fatalf("Expected an administratively prohibited error, got %+v", r.Result[2])
+	}
+	if _, err := json.Marshal(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAtlasNearHops(t *testing.T) {
+	trace := &Trace{
+		To: net.ParseIP("10.0.0.1"),
+		Route: Route{
+			{TTL: 1, IP: net.ParseIP("192.168.0.1")},
+			{TTL: 3, IP: net.ParseIP("192.168.1.1")},
+			{TTL: 4, IP: net.ParseIP("10.0.0.1")},
+		},
+	}
+	r := trace.Atlas()
+	if len(r.Result) != 4 || r.Result[0].Hop != 1 || r.Result[0].Result[0].From != "192.168.0.1" {
+		t.Fatalf("Expected hops from ttl 1, got %+v", r.Result)
+	}
+	if r.Result[1].Result[0].X != "*" || r.Result[2].Result[0].From != "192.168.1.1" {
+		t.Fatalf("Unexpected hops %+v", r.Result)
+	}
+}
@@ -0,0 +1,161 @@
+// Package client runs traces against a traas server, and fetches completed traces.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/willscott/traas2"
+)
+
+// maxRedirects bounds the redirects followed while running a trace.
+const maxRedirects = 10
+
+// ErrTraceFailed is returned when the server redirects to its error page.
+var ErrTraceFailed = errors.New("traas: server could not trace this client")
+
+// ErrNoTrace is returned when the server has no trace to return.
+var ErrNoTrace = errors.New("traas: no trace was recorded")
+
+// StatusError is returned for unexpected HTTP responses.
+type StatusError struct {
+	URL    string
+	Status string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("traas: %s responded %s", e.URL, e.Status)
+}
+
+// Client runs traces against the traas server at a base URL.
+type Client struct {
+	base *url.URL
+	http *http.Client
+}
+
+// New creates a client for the traas server at base, including its path,
+// like "http://example.com/traas". Requests are made with hc, or with a
+// client of its own if hc is nil.
+func New(base string, hc *http.Client) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if hc == nil {
+		hc = &http.Client{Transport: newTransport(nil)}
+	}
+	// Redirects are followed by the client, so that each hop can be checked.
+	c := *hc
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Client{base: u, http: &c}, nil
+}
+
+// NewWithDialer creates a client for the traas server at base whose connections are made with dial.
+func NewWithDialer(base string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*Client, error) {
+	return New(base, &http.Client{Transport: newTransport(dial)})
+}
+
+// newTransport creates a transport for traces. The probe is an HTTP/1.1
+// response injected into the connection, so HTTP/2 is not used.
+func newTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	t := &http.Transport{
+		Proxy:        http.ProxyFromEnvironment,
+		DialContext:  dial,
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+	if dial == nil {
+		t.DialContext = (&net.Dialer{}).DialContext
+	}
+	return t
+}
+
+// endpoint resolves a path relative to the server's base.
+func (c *Client) endpoint(path string) *url.URL {
+	u := *c.base
+	u.Path += path
+	return &u
+}
+
+// Trace runs a trace of the path from the server to this client, and returns it once complete.
+func (c *Client) Trace(ctx context.Context) (*traas2.Trace, error) {
+	next := c.endpoint("/start")
+	next.RawQuery = "format=json"
+	for i := 0; i < maxRedirects; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// The probe leaves the connection it is injected on unusable, so no connection is reused.
+		req.Close = true
+		req.Header.Set("Accept", "application/json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			resp.Body.Close()
+			loc, err := resp.Location()
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasSuffix(loc.Path, "/error") {
+				return nil, ErrTraceFailed
+			}
+			next = loc
+			continue
+		}
+		return decodeTrace(resp)
+	}
+	return nil, errors.New("traas: too many redirects")
+}
+
+// Get fetches a completed trace by its ID.
+func (c *Client) Get(ctx context.Context, id string) (*traas2.Trace, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.endpoint("/trace/"+url.PathEscape(id)).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNoTrace
+	}
+	return decodeTrace(resp)
+}
+
+// decodeTrace reads the trace in a response.
+func decodeTrace(resp *http.Response) (*traas2.Trace, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, &StatusError{URL: resp.Request.URL.String(), Status: resp.Status, Code: resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, ErrNoTrace
+	}
+	t := new(traas2.Trace)
+	if err := json.Unmarshal(body, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
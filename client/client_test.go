@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// fakeServer answers the trace flow the way a traas server at /traas does,
+// with the probe's injected redirect in place of the probe handler.
+func fakeServer(t *testing.T, probe http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/traas/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "json" {
+			t.Errorf("Expected a json trace, got %q", r.URL.RawQuery)
+		}
+		http.Redirect(w, r, "/traas/probe", 302)
+	})
+	mux.HandleFunc("/traas/probe", probe)
+	mux.HandleFunc("/traas/done", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&traas2.Trace{
+			ID:    "abc",
+			To:    net.ParseIP("127.0.0.1"),
+			Route: traas2.Route{{TTL: 4, IP: net.ParseIP("10.0.0.1"), Latency: time.Millisecond}},
+		})
+	})
+	mux.HandleFunc("/traas/error", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\"Error.\""))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestTrace(t *testing.T) {
+	srv := fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if !r.Close {
+			t.Error("Expected the probed connection to be closed")
+		}
+		http.Redirect(w, r, "./done?format=json", 302)
+	})
+	defer srv.Close()
+
+	c, err := New(srv.URL+"/traas/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := c.Trace(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.ID != "abc" || len(tr.Route) != 1 || !tr.Route[0].IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Unexpected trace %+v", tr)
+	}
+}
+
+func TestTraceErrors(t *testing.T) {
+	srv := fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer srv.Close()
+
+	c, _ := NewWithDialer(srv.URL+"/traas", (&net.Dialer{}).DialContext)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Trace(ctx); err == nil || ctx.Err() == nil {
+		t.Fatalf("Expected the trace to be cancelled, got %v", err)
+	}
+	if _, err := c.Get(context.Background(), "missing"); err != ErrNoTrace {
+		t.Fatalf("Expected no trace, got %v", err)
+	}
+
+	failing := fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/traas/error", 302)
+	})
+	defer failing.Close()
+	c, _ = New(failing.URL+"/traas", nil)
+	if _, err := c.Trace(context.Background()); err != ErrTraceFailed {
+		t.Fatalf("Expected the trace to fail, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package traas2
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed demo
+var demoFiles embed.FS
+
+// Demo returns the files of the demo site, which are embedded in the package.
+func Demo() fs.FS {
+	demo, err := fs.Sub(demoFiles, "demo")
+	if err != nil {
+		panic(err)
+	}
+	return demo
+}
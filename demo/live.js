@@ -0,0 +1,42 @@
+var el = document.getElementById('traceroute');
+
+function calcLatency(ns) {
+  let ms = ns / 1000000.0;
+  return +ms.toFixed(2) + "ms";
+};
+
+var url = new URL('../ws', window.location.href);
+url.protocol = url.protocol.replace('http', 'ws');
+var ws = new WebSocket(url.href);
+
+ws.onopen = function() {
+  el.innerHTML = "";
+  ws.send("start");
+};
+
+ws.onmessage = function(evt) {
+  var msg;
+  try {
+    msg = JSON.parse(evt.data);
+  } catch (e) {
+    return;
+  }
+  if (msg.type == "hop") {
+    el.innerHTML += msg.hop.TTL + " - " + msg.hop.IP + " - " + calcLatency(msg.hop.Latency) + "\n";
+  } else if (msg.type == "summary") {
+    var data = msg.trace;
+    var next = document.createElement("div");
+    var ih ="<h4>Route to " + data.To + "</h4><ul>";
+    for (var i = 0; i < data.Route.length; i++) {
+      ih += "<li><b>" + data.Route[i].TTL +"</b> - " + data.Route[i].IP + " - " + calcLatency(data.Route[i].Latency)+ "</li>";
+    }
+    ih += "</ul>";
+    next.innerHTML = ih;
+    el.parentNode.appendChild(next);
+  }
+};
+
+ws.onerror = function(err) {
+  el.style.Color = '#ff0000';
+  el.innerHTML = "Connection failed.";
+};
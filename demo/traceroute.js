@@ -5,6 +5,22 @@ function calcLatency(ns) {
   return +ms.toFixed(2) + "ms";
 };
 
+// Show hops as they are recorded while the trace runs.
+var live = document.createElement("div");
+el.parentNode.appendChild(live);
+var events = new EventSource('../events');
+events.addEventListener('hop-received', function(evt) {
+  var ev = JSON.parse(evt.data);
+  live.innerHTML += ev.hop.TTL + " - " + ev.hop.IP + " - " + calcLatency(ev.hop.Latency) + "<br/>";
+});
+events.addEventListener('trace-complete', function() {
+  events.close();
+  live.innerHTML = "";
+});
+events.onerror = function() {
+  events.close();
+};
+
 fetch('../start').then(function(resp) {
   return resp.text();
 }).then(function(body) {
@@ -24,7 +40,7 @@ fetch('../start').then(function(resp) {
   }
   el.innerHTML = "";
   var next = document.createElement("div");
-  var ih ="<h4>Route to " + data.To + "</h4><ul>";
+  var ih ="<h4>Route to " + data.To + "</h4><p>Trace ID: " + data.ID + "</p><ul>";
   for (var i = 0; i < data.Route.length; i++) {
     ih += "<li><b>" + data.Route[i].TTL +"</b> - " + data.Route[i].IP + " - " + calcLatency(data.Route[i].Latency)+ "</li>";
   }
@@ -0,0 +1,116 @@
+package traas2
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ResultVersion is the version of the Result schema.
+const ResultVersion = 2
+
+// Result is the stable, versioned JSON representation of a trace.
+type Result struct {
+	Version int         `json:"version"`
+	ID      string      `json:"id"`
+	Client  string      `json:"client"`
+	Started time.Time   `json:"started"`
+	Reached bool        `json:"reached"`
+	Hops    []ResultHop `json:"hops"`
+}
+
+// ResultHop is a single responding hop of a Result.
+type ResultHop struct {
+	TTL      uint8     `json:"ttl"`
+	IP       string    `json:"ip"`
+	RTT      float64   `json:"rtt_ms"`
+	Received time.Time `json:"received"`
+}
+
+// RTT estimates the round trip time to a hop, which is twice its latency.
+func (h Hop) RTT() time.Duration {
+	return 2 * h.Latency
+}
+
+// millis converts a duration to fractional milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Result converts a trace to its versioned JSON representation.
+func (t *Trace) Result() Result {
+	r := Result{
+		Version: ResultVersion,
+		ID:      t.ID,
+		Client:  t.To.String(),
+		Started: t.Started,
+		Reached: t.Reached,
+		Hops:    make([]ResultHop, 0, len(t.Route)),
+	}
+	for _, hop := range t.Route {
+		r.Hops = append(r.Hops, ResultHop{
+			TTL:      hop.TTL,
+			IP:       hop.IP.String(),
+			RTT:      millis(hop.RTT()),
+			Received: hop.Received,
+		})
+	}
+	return r
+}
+
+// WriteText writes a trace as a classic traceroute table, with a line per TTL.
+// TTLs without a reply are shown as '*'.
+func (t *Trace) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "traceroute to %s (trace %s), %d hops max\n", t.To, t.ID, TraceLongestTTL); err != nil {
+		return err
+	}
+	if len(t.Route) == 0 {
+		_, err := fmt.Fprintf(w, "no hops recorded\n")
+		return err
+	}
+	next := 0
+	last := int(t.Route[len(t.Route)-1].TTL)
+	for ttl := int(t.Route[0].TTL); ttl <= last; ttl++ {
+		line := fmt.Sprintf("%2d ", ttl)
+		var prev string
+		for ; next < len(t.Route) && int(t.Route[next].TTL) == ttl; next++ {
+			hop := t.Route[next]
+			if ip := hop.IP.String(); ip != prev {
+				line += " " + ip
+				prev = ip
+			}
+			line += fmt.Sprintf("  %.3f ms", millis(hop.RTT()))
+		}
+		if prev == "" {
+			line += " *"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CSVHeader is the first row written by WriteCSV.
+var CSVHeader = []string{"id", "client", "ttl", "ip", "rtt_ms", "received"}
+
+// WriteCSV writes the hops of a trace as CSV rows, without a header.
+func (t *Trace) WriteCSV(w *csv.Writer) error {
+	for _, hop := range t.Route {
+		err := w.Write([]string{
+			t.ID,
+			t.To.String(),
+			strconv.Itoa(int(hop.TTL)),
+			hop.IP.String(),
+			strconv.FormatFloat(millis(hop.RTT()), 'f', 3, 64),
+			hop.Received.Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,56 @@
+package traas2
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTrace() *Trace {
+	return &Trace{
+		ID: "abc",
+		To: net.ParseIP("10.0.0.1"),
+		Route: Route{
+			{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond},
+			{TTL: 6, IP: net.ParseIP("192.168.1.1"), Latency: 2 * time.Millisecond},
+		},
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testTrace().WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and a line per ttl, got %q", buf.String())
+	}
+	if lines[1] != " 4  192.168.0.1  2.000 ms" || lines[2] != " 5  *" || lines[3] != " 6  192.168.1.1  4.000 ms" {
+		t.Fatalf("Unexpected traceroute table %q", buf.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testTrace().WriteCSV(csv.NewWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || len(rows[0]) != len(CSVHeader) || rows[1][3] != "192.168.1.1" || rows[1][4] != "4.000" {
+		t.Fatalf("Unexpected csv %v", rows)
+	}
+}
+
+func TestResult(t *testing.T) {
+	r := testTrace().Result()
+	if r.Version != ResultVersion || r.Client != "10.0.0.1" || len(r.Hops) != 2 || r.Hops[0].RTT != 2 {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+}
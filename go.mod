@@ -1,8 +1,10 @@
 module github.com/willscott/traas2
 
-go 1.12
+go 1.16
 
 require (
 	github.com/google/gopacket v1.1.17
 	github.com/orcaman/concurrent-map v0.0.0-20190826125027-8c72a8bb44f6
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/sys v0.7.0 // indirect
 )
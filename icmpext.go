@@ -0,0 +1,74 @@
+package traas2
+
+import "encoding/binary"
+
+// ICMP extension object classes, per RFC 4950
+const (
+	ICMPExtensionClassMPLS = 1
+)
+
+// icmpOriginalDatagramMin is the padded length of the quoted datagram when
+// extensions are present, per RFC 4884 section 5.
+const icmpOriginalDatagramMin = 128
+
+// ICMPExtension is an object from the RFC 4884 extension structure of an ICMP message.
+type ICMPExtension struct {
+	Class uint8
+	Type  uint8
+	Data  []byte      `json:",omitempty"`
+	MPLS  []MPLSLabel `json:",omitempty"`
+}
+
+// MPLSLabel is an entry of an MPLS label stack extension, per RFC 4950.
+type MPLSLabel struct {
+	Label uint32
+	Exp   uint8
+	S     bool
+	TTL   uint8
+}
+
+// ParseICMPExtensions reads the extension objects following the original
+// datagram in the payload of an ICMP time exceeded or destination unreachable
+// message. length is the RFC 4884 length of the original datagram in 32 bit
+// words, which is zero for messages that don't set it.
+func ParseICMPExtensions(payload []byte, length uint8) []ICMPExtension {
+	offset := int(length) * 4
+	if offset == 0 {
+		// Non-compliant implementations place extensions after 128 bytes without a length.
+		offset = icmpOriginalDatagramMin
+	} else if offset < icmpOriginalDatagramMin {
+		return nil
+	}
+	if len(payload) < offset+4 {
+		return nil
+	}
+	ext := payload[offset:]
+	if ext[0]>>4 != 2 {
+		return nil
+	}
+	var objects []ICMPExtension
+	for ext = ext[4:]; len(ext) >= 4; {
+		objLen := int(binary.BigEndian.Uint16(ext[0:2]))
+		if objLen < 4 || objLen > len(ext) {
+			break
+		}
+		obj := ICMPExtension{Class: ext[2], Type: ext[3]}
+		data := ext[4:objLen]
+		if obj.Class == ICMPExtensionClassMPLS && obj.Type == 1 {
+			for ; len(data) >= 4; data = data[4:] {
+				entry := binary.BigEndian.Uint32(data)
+				obj.MPLS = append(obj.MPLS, MPLSLabel{
+					Label: entry >> 12,
+					Exp:   uint8(entry>>9) & 0x7,
+					S:     entry&0x100 != 0,
+					TTL:   uint8(entry),
+				})
+			}
+		} else {
+			obj.Data = append([]byte(nil), data...)
+		}
+		objects = append(objects, obj)
+		ext = ext[objLen:]
+	}
+	return objects
+}
@@ -20,16 +20,23 @@ const TraceLongestTTL = 32
 // Probe represents a tcp injection.
 type Probe struct {
 	Payload []byte
+	// Trigger reports if a client payload should start injection. If nil, the
+	// recorder waits for the HTTP request for the probe path.
+	Trigger func(payload []byte) bool
 }
 
 // Hop represents the traceroute at a single TTL
 type Hop struct {
-	TTL      uint8
-	IP       net.IP
-	Sent     time.Time `json:"-"`
-	Received time.Time
-	Latency  time.Duration
-	Packet   gopacket.Packet
+	TTL        uint8
+	IP         net.IP
+	Sent       time.Time `json:"-"`
+	Received   time.Time
+	Latency    time.Duration
+	ICMPType   uint8
+	ICMPCode   uint8
+	ReplyTTL   uint8
+	Extensions []ICMPExtension `json:",omitempty"`
+	Packet     gopacket.Packet
 }
 
 // Route is a sortable list of hops
@@ -41,10 +48,61 @@ func (r Route) Less(i, j int) bool { return r[i].TTL < r[j].TTL }
 
 // Trace represents the stored state for an ongoing traceroute
 type Trace struct {
+	ID       string
+	Source   string `json:",omitempty"` // Empty for recorded reverse traces, or the format of imported ones
+	From     net.IP
 	To       net.IP
+	Started  time.Time
 	Sent     time.Time
 	Recorded uint16 `json:"-"`
 	Route    Route
+	Reached  bool
+	State    State                `json:",omitempty"`
+	Changed  time.Time            `json:"-"` // When State was entered
 	Hops     [TraceMaxReplies]Hop `json:"-"`
 	Cancel   context.CancelFunc   `json:"-"`
+	Probe    *Probe               `json:"-"`
+	ProbeSeq uint32               `json:"-"`
+}
+
+// State is a stage in the lifecycle of a trace.
+type State string
+
+// States of a trace. A trace is pending until the client's request triggers
+// probing, and collecting replies once all probes are sent. It ends complete
+// when the client fetches the result, expired if it stays in a state too
+// long, or cancelled if a new trace of the same client replaces it.
+const (
+	StatePending    State = "pending"
+	StateTriggered  State = "triggered"
+	StateProbing    State = "probing"
+	StateCollecting State = "collecting"
+	StateComplete   State = "complete"
+	StateExpired    State = "expired"
+	StateCancelled  State = "cancelled"
+)
+
+// Done reports if a state ends the lifecycle of a trace.
+func (s State) Done() bool {
+	return s == StateComplete || s == StateExpired || s == StateCancelled
+}
+
+// Event types published as a trace progresses.
+const (
+	EventTraceStart         = "trace-start"
+	EventHopReceived        = "hop-received"
+	EventHopTimeout         = "hop-timeout"
+	EventDestinationReached = "destination-reached"
+	EventTraceComplete      = "trace-complete"
+	EventStateChange        = "state-change"
+)
+
+// Event is a notification of progress on a trace.
+type Event struct {
+	Type  string    `json:"type"`
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Hop   *Hop      `json:"hop,omitempty"`
+	State State     `json:"state,omitempty"`
+	Trace *Trace    `json:"trace,omitempty"`
 }
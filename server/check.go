@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	server "github.com/willscott/traas2/server/lib"
+)
+
+// check reports every problem with the configuration, and fails if there are any.
+func check(config server.Config, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	problems := server.Check(config)
+	for _, p := range problems {
+		fmt.Printf("* %s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Printf("Configuration OK: serving %s on port %d, capturing on %s port %d.\n", config.Path, config.ServePort, config.Device, config.ListenPort)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	server "github.com/willscott/traas2/server/lib"
+)
+
+// initConfig writes a new configuration file. Without flags, values are asked for interactively.
+func initConfig(file string, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	servePort := flags.Int("port", 8080, "TCP port for web socket")
+	listenPort := flags.Int("lport", 8080, "TCP port for incoming connection listening")
+	path := flags.String("path", "", "prefix for web requests")
+	root := flags.String("root", "", "directory with a demo/ folder of files overriding the embedded demo site")
+	device := flags.String("device", "eth0", "inet device for pcap to use")
+	dstMAC := flags.String("dstMAC", "000000000000", "Ethernet DST for sending")
+	originHeader := flags.String("originHeader", "", "Client IPs are forwarded in a http header")
+	logFile := flags.String("log", "", "where to log completed traces. If not set, will log to stderr")
+	database := flags.String("database", "", "file of an on-disk trace database. If not set, traces are kept in memory")
+	interactive := flags.Bool("interactive", false, "ask for each value, with flags as defaults. This is the default without other flags")
+	force := flags.Bool("force", false, "overwrite an existing configuration")
+	flags.Parse(args)
+
+	if _, err := os.Stat(file); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", file)
+	}
+
+	config := server.Config{
+		ServePort:  uint16(*servePort),
+		ListenPort: uint16(*listenPort),
+		Path:       *path,
+		Root:       *root,
+		Device:     *device,
+		Dst:        *dstMAC,
+		IPHeader:   *originHeader,
+		TraceFile:  *logFile,
+		Database:   *database,
+	}
+	if *interactive || flags.NFlag() == 0 {
+		if err := askConfig(bufio.NewReader(os.Stdin), os.Stdout, &config); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(file), 0700)
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s. Run the check command to validate it.\n", file)
+	return nil
+}
+
+// askConfig asks for the main values of a configuration, keeping current values as defaults.
+func askConfig(in *bufio.Reader, out io.Writer, config *server.Config) error {
+	ask := func(question, def string) (string, error) {
+		fmt.Fprintf(out, "%s [%s]: ", question, def)
+		answer, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || answer == "") {
+			return "", errors.New("no answer given")
+		}
+		if answer = strings.TrimSpace(answer); answer != "" {
+			return answer, nil
+		}
+		return def, nil
+	}
+	askPort := func(question string, port *uint16) error {
+		answer, err := ask(question, strconv.Itoa(int(*port)))
+		if err != nil {
+			return err
+		}
+		p, err := strconv.ParseUint(answer, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", answer)
+		}
+		*port = uint16(p)
+		return nil
+	}
+
+	if err := askPort("Port to serve HTTP on", &config.ServePort); err != nil {
+		return err
+	}
+	if err := askPort("Port clients connect to, if behind a proxy", &config.ListenPort); err != nil {
+		return err
+	}
+	questions := []struct {
+		question string
+		value    *string
+	}{
+		{"Path prefix of web requests", &config.Path},
+		{"Network device to capture on", &config.Device},
+		{"Ethernet address of the gateway, in hex", &config.Dst},
+		{"Header with client IPs, if behind a proxy", &config.IPHeader},
+		{"File to log traces to, or empty for stderr", &config.TraceFile},
+		{"Trace database file, or empty to keep traces in memory", &config.Database},
+	}
+	for _, q := range questions {
+		answer, err := ask(q.question, *q.value)
+		if err != nil {
+			return err
+		}
+		*q.value = answer
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// probedTTLs is how many TTLs are probed in a trace.
+const probedTTLs = traas2.TraceLongestTTL - traas2.TraceShortestTTL
+
+// activeTrace is a trace being recorded. The packet capture, the probes being
+// sent and the server all update it, so the trace is only used with the lock
+// held, and others are given snapshots of it.
+type activeTrace struct {
+	sync.Mutex
+	id    string
+	to    net.IP
+	trace *traas2.Trace
+	// sent is when the probe of each TTL was sent.
+	sent [probedTTLs]time.Time
+}
+
+func newActiveTrace(t *traas2.Trace) *activeTrace {
+	return &activeTrace{id: t.ID, to: t.To, trace: t}
+}
+
+// snapshot copies the trace, as it is now, for readers.
+func (a *activeTrace) snapshot() *traas2.Trace {
+	a.Lock()
+	defer a.Unlock()
+	return a.snapshotLocked()
+}
+
+func (a *activeTrace) snapshotLocked() *traas2.Trace {
+	t := *a.trace
+	t.Route = append(traas2.Route(nil), a.trace.Route...)
+	return &t
+}
+
+// probe is the probe injected for the trace, or def if it has none of its own.
+func (a *activeTrace) probe(def *traas2.Probe) *traas2.Probe {
+	a.Lock()
+	defer a.Unlock()
+	if a.trace.Probe != nil {
+		return a.trace.Probe
+	}
+	return def
+}
+
+// setState moves the trace to a state, if it may, and returns a snapshot of it after the move.
+func (a *activeTrace) setState(to traas2.State, at time.Time) (*traas2.Trace, bool) {
+	a.Lock()
+	defer a.Unlock()
+	if !canTransition(a.trace.State, to) {
+		return nil, false
+	}
+	a.trace.State = to
+	a.trace.Changed = at
+	return a.snapshotLocked(), true
+}
+
+// state is the state of the trace, and when it was entered.
+func (a *activeTrace) state() (traas2.State, time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	return a.trace.State, a.trace.Changed
+}
+
+// trigger notes that probing was triggered at a time, by a request to the
+// server address from, whose probes have sequence number seq. It reports
+// false if it already was.
+func (a *activeTrace) trigger(seq uint32, from net.IP, at time.Time, cancel context.CancelFunc) bool {
+	a.Lock()
+	defer a.Unlock()
+	if !a.trace.Sent.IsZero() {
+		return false
+	}
+	a.trace.ProbeSeq = seq
+	a.trace.From = from
+	a.trace.Sent = at
+	a.trace.Cancel = cancel
+	return true
+}
+
+// triggered checks if probing has been triggered.
+func (a *activeTrace) triggered() bool {
+	a.Lock()
+	defer a.Unlock()
+	return !a.trace.Sent.IsZero()
+}
+
+// cancel stops probing, if it has begun.
+func (a *activeTrace) cancel() {
+	a.Lock()
+	cancel := a.trace.Cancel
+	a.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// setSent records when the probe with a given TTL was sent.
+func (a *activeTrace) setSent(ttl uint8, at time.Time) {
+	if ttl < traas2.TraceShortestTTL || ttl >= traas2.TraceLongestTTL {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.sent[ttl-traas2.TraceShortestTTL] = at
+}
+
+// recordSent records when a captured probe was sent, if it has the sequence
+// number of the trace's probes.
+func (a *activeTrace) recordSent(seq uint32, ttl uint8, at time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	if a.trace.Sent.IsZero() || seq != a.trace.ProbeSeq || ttl < traas2.TraceShortestTTL || ttl >= traas2.TraceLongestTTL {
+		return
+	}
+	a.sent[ttl-traas2.TraceShortestTTL] = at
+}
+
+// sentAt is when the probe with a given TTL was sent, or the zero time if it wasn't.
+func (a *activeTrace) sentAt(ttl uint8) time.Time {
+	a.Lock()
+	defer a.Unlock()
+	return a.sentAtLocked(ttl)
+}
+
+func (a *activeTrace) sentAtLocked(ttl uint8) time.Time {
+	if ttl < traas2.TraceShortestTTL || ttl >= traas2.TraceLongestTTL {
+		return time.Time{}
+	}
+	return a.sent[ttl-traas2.TraceShortestTTL]
+}
+
+// lastSentTTL finds the largest TTL that has been probed so far.
+func (a *activeTrace) lastSentTTL() uint8 {
+	a.Lock()
+	defer a.Unlock()
+	return a.lastSentTTLLocked()
+}
+
+func (a *activeTrace) lastSentTTLLocked() uint8 {
+	for i := probedTTLs - 1; i >= 0; i-- {
+		if !a.sent[i].IsZero() {
+			return uint8(i + traas2.TraceShortestTTL)
+		}
+	}
+	return 0
+}
+
+// addHop records a reply, with its latency from when its probe was sent.
+// It reports false if the trace can hold no more replies.
+func (a *activeTrace) addHop(hop traas2.Hop) (traas2.Hop, bool) {
+	a.Lock()
+	defer a.Unlock()
+	if a.trace.Recorded >= traas2.TraceMaxReplies {
+		return hop, false
+	}
+	hop.Sent = a.sentAtLocked(hop.TTL)
+	hop.Latency = hop.Received.Sub(hop.Sent) / 2
+	a.trace.Hops[a.trace.Recorded] = hop
+	a.trace.Recorded++
+	return hop, true
+}
+
+// reach notes that the client acknowledged a probe, with acknowledgement
+// number ack. If this newly reaches the client, the TTL of the last probe sent
+// is returned.
+func (a *activeTrace) reach(ack uint32) (uint8, bool) {
+	a.Lock()
+	defer a.Unlock()
+	ttl := a.lastSentTTLLocked()
+	if a.trace.Reached || ttl == 0 || int32(ack-a.trace.ProbeSeq) <= 0 {
+		return 0, false
+	}
+	a.trace.Reached = true
+	return ttl, true
+}
+
+// answered checks if a reply has been recorded for a given TTL.
+func (a *activeTrace) answered(ttl uint8) bool {
+	a.Lock()
+	defer a.Unlock()
+	for i := uint16(0); i < a.trace.Recorded; i++ {
+		if a.trace.Hops[i].TTL == ttl {
+			return true
+		}
+	}
+	return false
+}
+
+// buildRoute sorts the recorded hops into the route of the trace, and returns a snapshot of it.
+func (a *activeTrace) buildRoute() *traas2.Trace {
+	a.Lock()
+	defer a.Unlock()
+	buildRoute(a.trace)
+	return a.snapshotLocked()
+}
+
+// buildRoute sorts and creates the route from recorded hops.
+func buildRoute(t *traas2.Trace) {
+	hops := make(traas2.Route, t.Recorded)
+	for i := uint16(0); i < t.Recorded; i++ {
+		hops[i] = t.Hops[i]
+	}
+	sort.Sort(hops)
+	t.Route = hops
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+
+	"github.com/willscott/traas2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the on-disk trace database.
+// Index keys are an optional 16 byte IP, then the 8 byte start time, then the trace id.
+// Keys of the stored index are the 8 byte time a trace was stored, then its id,
+// and values of the time index are the time each trace was stored.
+var (
+	tracesBucket = []byte("traces")
+	timeBucket   = []byte("time")
+	clientBucket = []byte("client")
+	hopBucket    = []byte("hop")
+	storedBucket = []byte("stored")
+)
+
+// pruneInterval is how often traces past retention are removed from disk.
+const pruneInterval = time.Hour
+
+// BoltStore keeps completed traces in an embedded on-disk database.
+type BoltStore struct {
+	db    *bolt.DB
+	ttl   time.Duration
+	clock Clock
+	done  chan struct{}
+}
+
+// OpenBoltStore opens or creates the trace database at path. Traces older than ttl, as told by clock, are removed.
+// readOnly databases can be opened alongside another reader, but are not pruned.
+func OpenBoltStore(path string, ttl time.Duration, clock Clock, readOnly bool) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{db: db, ttl: ttl, clock: clock, done: make(chan struct{})}
+	if readOnly {
+		return s, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{tracesBucket, timeBucket, clientBucket, hopBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(storedBucket) != nil {
+			return nil
+		}
+		// traces of databases older than the stored index are kept from when they started.
+		stored, err := tx.CreateBucket(storedBucket)
+		if err != nil {
+			return err
+		}
+		var keys [][]byte
+		tx.Bucket(timeBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		for _, k := range keys {
+			if err := stored.Put(k, nil); err != nil {
+				return err
+			}
+			if err := tx.Bucket(timeBucket).Put(k, k[:8]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.Prune(); err != nil {
+		log.Printf("Failed to prune trace database: %v\n", err)
+	}
+	go s.pruneLoop()
+	return s, nil
+}
+
+// indexKey builds an index key for a trace, prefixed by ip if not nil.
+func indexKey(ip net.IP, t *traas2.Trace) []byte {
+	key := make([]byte, 0, net.IPv6len+8+len(t.ID))
+	if ip != nil {
+		key = append(key, ip.To16()...)
+	}
+	key = append(key, timeKey(t.Started)...)
+	return append(key, t.ID...)
+}
+
+// timeKey encodes a time so that keys sort chronologically.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// Put writes a completed trace and its index entries. The trace is kept for
+// the store ttl from now.
+func (s *BoltStore) Put(t *traas2.Trace) error {
+	b, err := json.Marshal(withoutPackets(t))
+	if err != nil {
+		return err
+	}
+	stored := timeKey(s.clock.Now())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// a trace stored again replaces its index entries.
+		old, err := getTrace(tx, []byte(t.ID))
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if err := unindex(tx, old); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(tracesBucket).Put([]byte(t.ID), b); err != nil {
+			return err
+		}
+		if err := tx.Bucket(storedBucket).Put(append(stored, t.ID...), nil); err != nil {
+			return err
+		}
+		if err := tx.Bucket(timeBucket).Put(indexKey(nil, t), stored); err != nil {
+			return err
+		}
+		if err := tx.Bucket(clientBucket).Put(indexKey(t.To, t), nil); err != nil {
+			return err
+		}
+		for _, hop := range t.Route {
+			if hop.IP == nil {
+				continue
+			}
+			if err := tx.Bucket(hopBucket).Put(indexKey(hop.IP, t), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get reads the trace with a given id.
+func (s *BoltStore) Get(id string) (*traas2.Trace, error) {
+	var t *traas2.Trace
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getTrace(tx, []byte(id))
+		return err
+	})
+	return t, err
+}
+
+func getTrace(tx *bolt.Tx, id []byte) (*traas2.Trace, error) {
+	b := tx.Bucket(tracesBucket).Get(id)
+	if b == nil {
+		return nil, nil
+	}
+	t := new(traas2.Trace)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// List finds traces matching filter using the most selective index available.
+func (s *BoltStore) List(filter TraceFilter) ([]*traas2.Trace, error) {
+	matches := make([]*traas2.Trace, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket []byte
+		var first, last []byte
+		switch {
+		case filter.HopIP != nil:
+			bucket = hopBucket
+			first = filter.HopIP.To16()
+			last = first
+		case filter.Prefix != nil:
+			bucket = clientBucket
+			first, last = prefixRange(filter.Prefix)
+		default:
+			bucket = timeBucket
+		}
+		byTime := first == nil
+		seek := first
+		if byTime && !filter.Since.IsZero() {
+			seek = timeKey(filter.Since)
+		}
+		seen := make(map[string]bool)
+		c := tx.Bucket(bucket).Cursor()
+		for k, _ := c.Seek(seek); k != nil && len(k) > len(first)+8; k, _ = c.Next() {
+			if last != nil && bytes.Compare(k[:len(last)], last) > 0 {
+				break
+			}
+			if byTime && !filter.Until.IsZero() && bytes.Compare(k[:8], timeKey(filter.Until)) >= 0 {
+				break
+			}
+			id := k[len(first)+8:]
+			if seen[string(id)] {
+				continue
+			}
+			seen[string(id)] = true
+			t, err := getTrace(tx, id)
+			if err != nil {
+				return err
+			}
+			if t != nil && filter.Match(t) {
+				matches = append(matches, t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortTraces(matches)
+	return filter.limit(matches), nil
+}
+
+// prefixRange returns the first and last 16 byte addresses in a network.
+func prefixRange(network *net.IPNet) ([]byte, []byte) {
+	first := network.IP.Mask(network.Mask).To16()
+	last := make([]byte, net.IPv6len)
+	copy(last, first)
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range last {
+		last[i] |= ^mask[i]
+	}
+	return first, last
+}
+
+// Prune removes traces that were stored before the retention period.
+func (s *BoltStore) Prune() error {
+	cutoff := timeKey(s.clock.Now().Add(-s.ttl))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(storedBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, _ = c.First() {
+			id := append([]byte(nil), k[8:]...)
+			t, err := getTrace(tx, id)
+			if err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if t != nil {
+				if err := unindex(tx, t); err != nil {
+					return err
+				}
+				if err := tx.Bucket(tracesBucket).Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// unindex removes the index entries of a stored trace.
+func unindex(tx *bolt.Tx, t *traas2.Trace) error {
+	key := indexKey(nil, t)
+	if stored := tx.Bucket(timeBucket).Get(key); len(stored) == 8 {
+		if err := tx.Bucket(storedBucket).Delete(append(append([]byte(nil), stored...), t.ID...)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(timeBucket).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(clientBucket).Delete(indexKey(t.To, t)); err != nil {
+		return err
+	}
+	for _, hop := range t.Route {
+		if hop.IP != nil {
+			if err := tx.Bucket(hopBucket).Delete(indexKey(hop.IP, t)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) pruneLoop() {
+	for {
+		select {
+		case <-s.clock.After(pruneInterval):
+		case <-s.done:
+			return
+		}
+		if err := s.Prune(); err != nil {
+			log.Printf("Failed to prune trace database: %v\n", err)
+		}
+	}
+}
+
+// Close stops pruning and closes the database.
+func (s *BoltStore) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Check validates a configuration, and that the server can run with it on
+// this host: each device has an IPv4 address, its gateway MAC is set, packets
+// can be captured on it, and the capture filter compiles. Every problem found is returned.
+func Check(conf Config) []error {
+	var problems []error
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if conf.ServePort == 0 {
+		fail("ServePort must be set")
+	}
+	listeners := Listeners(conf)
+	paths := make(map[string]bool)
+	sinks := append([]SinkConfig(nil), conf.Sinks...)
+	for _, l := range listeners {
+		if l.ListenPort == 0 {
+			fail("ListenPort of %q must be set", l.Path)
+		}
+		if l.Path != "" && (!strings.HasPrefix(l.Path, "/") || strings.HasSuffix(l.Path, "/")) {
+			fail("Path %q must begin, and not end, with a /", l.Path)
+		}
+		if paths[l.Path] {
+			fail("Path %q is shared by listeners", l.Path)
+		}
+		paths[l.Path] = true
+		sinks = append(sinks, l.Sinks...)
+	}
+
+	devices := Devices(conf)
+	for _, dc := range devices {
+		mac, err := hex.DecodeString(dc.Dst)
+		if err != nil || len(mac) != 6 {
+			fail("Dst %q of %s is not an ethernet address", dc.Dst, dc.Device)
+		} else if strings.Trim(hex.EncodeToString(mac), "0") == "" {
+			fail("Dst of %s, the ethernet address of the gateway, is not set", dc.Device)
+		}
+	}
+
+	if _, err := StateTimeouts(conf); err != nil {
+		fail("Timeouts: %v", err)
+	}
+
+	for _, file := range []string{conf.Database, conf.TraceFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+			fail("No directory for %s", file)
+		}
+	}
+	for _, sc := range sinks {
+		if _, err := ParseTraceFilter("", sc.Prefix, sc.Hop, "", "", ""); err != nil {
+			fail("Sink %s: %v", sc.Target, err)
+		}
+		switch sc.Type {
+		case "file", "syslog", "unix", "webhook":
+		default:
+			fail("Sink %s: unknown type %q", sc.Target, sc.Type)
+		}
+	}
+
+	var addrs []net.IP
+	for _, dc := range devices {
+		a, err := deviceAddrs(dc)
+		if err != nil {
+			fail("Device %s: %v", dc.Device, err)
+		}
+		addrs = append(addrs, a...)
+	}
+	if len(addrs) == 0 {
+		return problems
+	}
+	filter := recorderFilter(addrs, listenerPorts(listeners)...)
+	captured := false
+	for _, dc := range devices {
+		handle, err := pcap.OpenLive(dc.Device, 2048, false, pcap.BlockForever)
+		if err != nil {
+			fail("Cannot capture on %s (capturing needs root or CAP_NET_RAW): %v", dc.Device, err)
+			continue
+		}
+		captured = true
+		if _, err := handle.CompileBPFFilter(filter); err != nil {
+			fail("Capture filter %q on %s: %v", filter, dc.Device, err)
+		}
+		handle.Close()
+	}
+	if !captured {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 2048, filter); err != nil {
+			fail("Capture filter %q: %v", filter, err)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,19 @@
+package server
+
+import "time"
+
+// Clock tells the time, and waits, for the timing of traces. Tests replace
+// it to control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time.
+type systemClock struct{}
+
+// SystemClock is the Clock of the real time.
+var SystemClock Clock = systemClock{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
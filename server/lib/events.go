@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/willscott/traas2"
+)
+
+// eventBacklog is how many events a subscriber may fall behind before events are dropped.
+const eventBacklog = traas2.TraceMaxReplies + 8
+
+// eventBus fans out trace events to subscribers.
+type eventBus struct {
+	sync.Mutex
+	subs map[string]map[chan traas2.Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[string]map[chan traas2.Event]struct{})}
+}
+
+// subscribe returns a channel of events for the trace with a given id.
+// An empty id subscribes to events of all traces.
+// The returned function must be called to release the subscription.
+func (b *eventBus) subscribe(id string) (<-chan traas2.Event, func()) {
+	ch := make(chan traas2.Event, eventBacklog)
+	b.Lock()
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[chan traas2.Event]struct{})
+	}
+	b.subs[id][ch] = struct{}{}
+	b.Unlock()
+
+	return ch, func() {
+		b.Lock()
+		delete(b.subs[id], ch)
+		if len(b.subs[id]) == 0 {
+			delete(b.subs, id)
+		}
+		b.Unlock()
+	}
+}
+
+// publish sends an event to subscribers. Slow subscribers miss events rather
+// than block the recorder, except the completion of a trace, which displaces
+// their oldest event so that streams of the trace always end.
+func (b *eventBus) publish(ev traas2.Event) {
+	b.Lock()
+	defer b.Unlock()
+	for _, key := range []string{ev.ID, ""} {
+		for ch := range b.subs[key] {
+			select {
+			case ch <- ev:
+			default:
+				if ev.Type == traas2.EventTraceComplete {
+					// publish is the only sender, so there is room once an event is taken.
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- ev
+				}
+			}
+		}
+	}
+}
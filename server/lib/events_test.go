@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/willscott/traas2"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	one, releaseOne := bus.subscribe("one")
+	all, releaseAll := bus.subscribe("")
+	defer releaseAll()
+
+	bus.publish(traas2.Event{Type: traas2.EventHopReceived, ID: "one"})
+	bus.publish(traas2.Event{Type: traas2.EventHopReceived, ID: "two"})
+
+	if ev := <-one; ev.ID != "one" {
+		t.Fatalf("Subscriber received event for trace %s", ev.ID)
+	}
+	select {
+	case ev := <-one:
+		t.Fatalf("Subscriber received unexpected event for trace %s", ev.ID)
+	default:
+	}
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 events for all traces, got %d", len(all))
+	}
+
+	releaseOne()
+	if _, ok := bus.subs["one"]; ok {
+		t.Fatal("Released subscription should be removed")
+	}
+
+	// Publishing must not block on subscribers that fall behind.
+	two, releaseTwo := bus.subscribe("two")
+	defer releaseTwo()
+	for i := 0; i < 2*eventBacklog; i++ {
+		bus.publish(traas2.Event{Type: traas2.EventHopTimeout, ID: "two"})
+	}
+	// but the completion of a trace is always delivered.
+	bus.publish(traas2.Event{Type: traas2.EventTraceComplete, ID: "two"})
+	var last traas2.Event
+	for len(two) > 0 {
+		last = <-two
+	}
+	if last.Type != traas2.EventTraceComplete {
+		t.Fatalf("Expected the trace to complete, got %+v", last)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/willscott/traas2"
+)
+
+// Output formats for traces.
+const (
+	formatJSON   = "json"
+	formatJSONv2 = "json2"
+	formatText   = "text"
+	formatCSV    = "csv"
+	formatAtlas  = "atlas"
+	formatWarts  = "warts"
+	formatHTML   = "html"
+)
+
+// mimeJSONv2 is the media type requesting the versioned traas2.Result schema.
+const mimeJSONv2 = "application/vnd.traas.v2+json"
+
+// mimeWarts is the media type of scamper warts files.
+const mimeWarts = "application/x-warts"
+
+// formatTypes maps formats to the content type of responses.
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatJSONv2: mimeJSONv2,
+	formatText:   "text/plain; charset=utf-8",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatAtlas:  "application/json",
+	formatWarts:  mimeWarts,
+	formatHTML:   "text/html; charset=utf-8",
+}
+
+// negotiateFormat picks the output format of a request, from its `format`
+// query parameter or else the first supported type in its Accept header.
+func negotiateFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatTypes[f]; ok {
+			return f
+		}
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case mimeJSONv2:
+			return formatJSONv2
+		case mimeWarts:
+			return formatWarts
+		case "text/html":
+			return formatHTML
+		case "text/plain":
+			return formatText
+		case "text/csv":
+			return formatCSV
+		case "application/json":
+			return formatJSON
+		}
+	}
+	return formatJSON
+}
+
+// writeTraces writes traces in the format negotiated for the request.
+// A single trace is written on its own, rather than as a list, if single is set.
+func writeTraces(w http.ResponseWriter, r *http.Request, traces []*traas2.Trace, single bool) {
+	format := negotiateFormat(r)
+	w.Header().Set("Content-Type", formatTypes[format])
+	w.Header().Add("Vary", "Accept")
+	switch format {
+	case formatText:
+		for i, t := range traces {
+			if i > 0 {
+				w.Write([]byte("\n"))
+			}
+			if err := t.WriteText(w); err != nil {
+				return
+			}
+		}
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(traas2.CSVHeader)
+		for _, t := range traces {
+			if err := t.WriteCSV(cw); err != nil {
+				return
+			}
+		}
+		cw.Flush()
+	case formatHTML:
+		writeHTML(w, traces)
+	case formatWarts:
+		traas2.WriteWarts(w, traces)
+	case formatJSONv2:
+		if single {
+			writeJSON(w, traces[0].Result())
+			return
+		}
+		results := make([]traas2.Result, 0, len(traces))
+		for _, t := range traces {
+			results = append(results, t.Result())
+		}
+		writeJSON(w, results)
+	case formatAtlas:
+		if single {
+			writeJSON(w, traces[0].Atlas())
+			return
+		}
+		results := make([]traas2.AtlasResult, 0, len(traces))
+		for _, t := range traces {
+			results = append(results, t.Atlas())
+		}
+		writeJSON(w, results)
+	default:
+		if single {
+			writeJSON(w, traces[0])
+			return
+		}
+		writeJSON(w, traces)
+	}
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, c := range []struct {
+		query, accept, format string
+	}{
+		{"", "", formatJSON},
+		{"?format=csv", "text/html", formatCSV},
+		{"?format=nonsense", "text/plain", formatText},
+		{"", "text/html,application/xhtml+xml;q=0.9", formatHTML},
+		{"", "image/png, " + mimeJSONv2, formatJSONv2},
+		{"", mimeWarts, formatWarts},
+		{"", "text/csv; charset=utf-8", formatCSV},
+		{"", "*/*", formatJSON},
+	} {
+		r := httptest.NewRequest("GET", "/traas/trace/abc"+c.query, nil)
+		r.Header.Set("Accept", c.accept)
+		if got := negotiateFormat(r); got != c.format {
+			t.Fatalf("Expected %q accepting %q to be %s, got %s", c.query, c.accept, c.format, got)
+		}
+	}
+}
+
+func TestWriteTraces(t *testing.T) {
+	trace := &traas2.Trace{ID: "abc", To: net.ParseIP("10.0.0.1"), Started: time.Unix(1500000000, 0),
+		Route: traas2.Route{{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond}}}
+	for _, c := range []struct {
+		format, contains string
+	}{
+		{formatJSON, `"ID":"abc"`},
+		{formatText, "192.168.0.1"},
+		{formatCSV, strings.Join(traas2.CSVHeader, ",")},
+		{formatAtlas, `"type":"traceroute"`},
+		{formatHTML, "<html"},
+	} {
+		w := httptest.NewRecorder()
+		writeTraces(w, httptest.NewRequest("GET", "/?format="+c.format, nil), []*traas2.Trace{trace}, true)
+		if ct := w.Header().Get("Content-Type"); ct != formatTypes[c.format] {
+			t.Fatalf("Expected %s to be %s, got %s", c.format, formatTypes[c.format], ct)
+		}
+		if !strings.Contains(w.Body.String(), c.contains) {
+			t.Fatalf("Expected %s to contain %q, got %q", c.format, c.contains, w.Body)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/willscott/traas2"
+)
+
+// htmlStyle is shared by the server rendered pages.
+const htmlStyle = `<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; }
+tr:nth-child(even) { background: #f4f4f4; }
+.rtt { text-align: right; font-family: monospace; }
+.bar { width: 20em; }
+.bar div { background: #4a90d9; height: 0.8em; }
+.note { color: #666; }
+</style>`
+
+// startPage is shown while a trace begins. Its refresh starts the trace with
+// plain redirects, so no scripting is needed.
+var startPage = template.Must(template.New("start").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="1; url={{.}}">
+<title>Reverse Traceroute</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>Reverse Traceroute</h1>
+<p>Tracing the path from this server back to you. This takes a few seconds.</p>
+<p>If nothing happens, <a href="{{.}}">start the trace</a>.</p>
+</body>
+</html>
+`))
+
+// resultPage renders traces as tables, with a bar showing the latency of each hop.
+var resultPage = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Reverse Traceroute</title>
+` + htmlStyle + `
+</head>
+<body>
+{{range .}}
+<h1>Reverse Traceroute to {{.Client}}</h1>
+<p>Trace <code>{{.ID}}</code>, started {{.Started}}.
+{{if .Reached}}Probes reached you.{{else}}Probes were not seen to reach you.{{end}}</p>
+{{if .Hops}}
+<table>
+<tr><th>TTL</th><th>Hop</th><th>RTT</th><th></th><th>Notes</th></tr>
+{{range .Hops}}
+<tr><td>{{.TTL}}</td><td>{{.IP}}</td><td class="rtt">{{.RTT}}</td><td class="bar">{{if .Width}}<div style="width: {{.Width}}%"></div>{{end}}</td><td class="note">{{.Note}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No hops were recorded.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// htmlTrace is the view of a trace rendered by resultPage.
+type htmlTrace struct {
+	ID      string
+	Client  string
+	Started string
+	Reached bool
+	Hops    []htmlHop
+}
+
+// htmlHop is a row of a rendered trace. TTLs without a reply have an IP of '*'.
+type htmlHop struct {
+	TTL   uint8
+	IP    string
+	RTT   string
+	Width int
+	Note  string
+}
+
+// icmpUnreachable names ICMP destination unreachable codes.
+var icmpUnreachable = map[uint8]string{
+	0:  "network unreachable",
+	1:  "host unreachable",
+	2:  "protocol unreachable",
+	3:  "port unreachable",
+	13: "administratively prohibited",
+}
+
+// newHTMLTrace builds the view of a trace, with a row for each TTL up to the last reply.
+func newHTMLTrace(t *traas2.Trace) htmlTrace {
+	view := htmlTrace{
+		ID:      t.ID,
+		Client:  t.To.String(),
+		Started: t.Started.Format(time.RFC1123),
+		Reached: t.Reached,
+	}
+	var slowest time.Duration
+	for _, hop := range t.Route {
+		if hop.RTT() > slowest {
+			slowest = hop.RTT()
+		}
+	}
+	if len(t.Route) == 0 {
+		return view
+	}
+
+	next := 0
+	last := int(t.Route[len(t.Route)-1].TTL)
+	for ttl := int(t.Route[0].TTL); ttl <= last; ttl++ {
+		replied := false
+		for ; next < len(t.Route) && int(t.Route[next].TTL) == ttl; next++ {
+			hop := t.Route[next]
+			row := htmlHop{
+				TTL:  hop.TTL,
+				IP:   hop.IP.String(),
+				RTT:  fmt.Sprintf("%.3f ms", float64(hop.RTT())/float64(time.Millisecond)),
+				Note: hopNote(hop),
+			}
+			if slowest > 0 {
+				row.Width = int(100 * hop.RTT() / slowest)
+			}
+			view.Hops = append(view.Hops, row)
+			replied = true
+		}
+		if !replied {
+			view.Hops = append(view.Hops, htmlHop{TTL: uint8(ttl), IP: "*", Note: "no reply"})
+		}
+	}
+	return view
+}
+
+// hopNote annotates a hop with unusual ICMP replies and MPLS labels.
+func hopNote(hop traas2.Hop) string {
+	note := ""
+	if hop.ICMPType == layers.ICMPv4TypeDestinationUnreachable {
+		if name, ok := icmpUnreachable[hop.ICMPCode]; ok {
+			note = name
+		} else {
+			note = fmt.Sprintf("unreachable (code %d)", hop.ICMPCode)
+		}
+	}
+	for _, ext := range hop.Extensions {
+		for _, l := range ext.MPLS {
+			if note != "" {
+				note += ", "
+			}
+			note += fmt.Sprintf("MPLS label %d", l.Label)
+		}
+	}
+	return note
+}
+
+// writeHTML renders traces as an HTML page.
+func writeHTML(w io.Writer, traces []*traas2.Trace) error {
+	views := make([]htmlTrace, 0, len(traces))
+	for _, t := range traces {
+		views = append(views, newHTMLTrace(t))
+	}
+	return resultPage.Execute(w, views)
+}
+
+// ViewHandler shows a page that runs a trace without scripting, and renders its result as HTML.
+func (s *Server) ViewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", formatTypes[formatHTML])
+	startPage.Execute(w, s.config.Path+"/start?format="+formatHTML)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+func TestWriteHTML(t *testing.T) {
+	trace := &traas2.Trace{
+		ID:      "abc",
+		To:      net.ParseIP("10.0.0.1"),
+		Started: time.Now(),
+		Route: traas2.Route{
+			{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond},
+			{TTL: 6, IP: net.ParseIP("10.0.0.1"), Latency: 2 * time.Millisecond, ICMPType: 3, ICMPCode: 13},
+		},
+	}
+	var out bytes.Buffer
+	if err := writeHTML(&out, []*traas2.Trace{trace}); err != nil {
+		t.Fatal(err)
+	}
+	page := out.String()
+	for _, want := range []string{"192.168.0.1", "2.000 ms", "width: 50%", "width: 100%", "no reply", "administratively prohibited"} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("Expected %q in page:\n%s", want, page)
+		}
+	}
+}
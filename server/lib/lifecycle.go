@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// transitions are the states each state of a trace may move to.
+var transitions = map[traas2.State][]traas2.State{
+	"":                     {traas2.StatePending},
+	traas2.StatePending:    {traas2.StateTriggered},
+	traas2.StateTriggered:  {traas2.StateProbing},
+	traas2.StateProbing:    {traas2.StateCollecting},
+	traas2.StateCollecting: {},
+}
+
+// defaultTimeouts are how long a trace may stay in each state before it expires.
+var defaultTimeouts = map[traas2.State]time.Duration{
+	traas2.StatePending:    30 * time.Second,
+	traas2.StateTriggered:  5 * time.Second,
+	traas2.StateProbing:    10 * time.Second,
+	traas2.StateCollecting: 30 * time.Second,
+}
+
+// reapInterval is how often traces are checked for expiry.
+const reapInterval = time.Second
+
+// StateTimeouts are the timeouts of trace states with those of a configuration.
+// Configured timeouts are in seconds, by state name.
+func StateTimeouts(conf Config) (map[traas2.State]time.Duration, error) {
+	timeouts := make(map[traas2.State]time.Duration, len(defaultTimeouts))
+	for state, d := range defaultTimeouts {
+		timeouts[state] = d
+	}
+	for name, secs := range conf.Timeouts {
+		state := traas2.State(name)
+		if _, ok := timeouts[state]; !ok {
+			return nil, fmt.Errorf("no timeout for trace state %q", name)
+		}
+		if secs <= 0 {
+			return nil, fmt.Errorf("timeout for trace state %q must be positive", name)
+		}
+		timeouts[state] = time.Duration(secs) * time.Second
+	}
+	return timeouts, nil
+}
+
+// canTransition checks if a trace may move between states. Any unfinished
+// trace can complete, expire or be cancelled.
+func canTransition(from, to traas2.State) bool {
+	if from.Done() {
+		return false
+	}
+	if to.Done() {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves a trace to a new state, and publishes the change.
+// It reports false, leaving the trace as it was, if the move isn't allowed.
+func (r *Recorder) transition(trace *activeTrace, to traas2.State) bool {
+	t, ok := trace.setState(to, r.clock.Now())
+	if !ok {
+		return false
+	}
+	if r.debug {
+		log.Printf("Trace %s is %s\n", t.ID, to)
+	}
+	r.events.publish(traas2.Event{Type: traas2.EventStateChange, ID: t.ID, Time: t.Changed, State: to, Trace: t})
+	return true
+}
+
+// reap expires traces that have stayed in a state longer than its timeout.
+func (r *Recorder) reap() {
+	now := r.clock.Now()
+	for item := range r.handlers.IterBuffered() {
+		trace := item.Val.(*activeTrace)
+		state, changed := trace.state()
+		if timeout, ok := r.timeouts[state]; ok && now.Sub(changed) > timeout {
+			if t := r.finishTrace(trace, traas2.StateExpired); t != nil && r.expired != nil {
+				r.expired(t)
+			}
+		}
+	}
+}
+
+// reapTraces expires traces every reapInterval, until the recorder is closed.
+func (r *Recorder) reapTraces() {
+	defer r.running.Done()
+	for {
+		select {
+		case <-r.clock.After(reapInterval):
+			r.reap()
+		case <-r.done:
+			return
+		}
+	}
+}
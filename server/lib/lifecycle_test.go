@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// nextState reads events until a change of state, and returns the new state.
+func nextState(t *testing.T, events <-chan traas2.Event) traas2.State {
+	t.Helper()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == traas2.EventStateChange {
+				return ev.State
+			}
+		default:
+			t.Fatal("Expected a change of state")
+		}
+	}
+}
+
+func TestTraceExpiry(t *testing.T) {
+	clock := newFakeClock()
+	r := newRecorder(nil, simListeners, redirectProbe("./done", nil), false)
+	r.clock = clock
+	events, unsubscribe := r.Subscribe("")
+	defer unsubscribe()
+	client := net.ParseIP("10.0.0.1")
+
+	r.BeginTrace(client, nil)
+	trace := r.active(client)
+	if s := nextState(t, events); s != traas2.StatePending || r.GetTrace(client).State != s {
+		t.Fatalf("Expected a new trace to be pending, got %s", s)
+	}
+	clock.Advance(defaultTimeouts[traas2.StatePending])
+	r.reap()
+	if r.active(client) != trace {
+		t.Fatal("Expected the trace to last until its timeout")
+	}
+
+	// Timeouts are of the current state, from when it was entered.
+	if !r.transition(trace, traas2.StateTriggered) || nextState(t, events) != traas2.StateTriggered {
+		t.Fatal("Expected the trace to be triggered")
+	}
+	clock.Advance(defaultTimeouts[traas2.StateTriggered] + time.Millisecond)
+	r.reap()
+	if r.GetTrace(client) != nil || nextState(t, events) != traas2.StateExpired {
+		t.Fatal("Expected the trace to expire")
+	}
+	if s, _ := trace.state(); s != traas2.StateExpired || r.EndTrace(client) != nil {
+		t.Fatalf("Expected an expired trace to stay expired, got %s", s)
+	}
+}
+
+func TestTraceTransitions(t *testing.T) {
+	r := newRecorder(nil, simListeners, redirectProbe("./done", nil), false)
+	client := net.ParseIP("10.0.0.1")
+
+	// A new trace of a client cancels the last.
+	r.BeginTrace(client, nil)
+	first := r.active(client)
+	r.BeginTrace(client, nil)
+	second := r.active(client)
+	if s, _ := first.state(); s != traas2.StateCancelled || second == first {
+		t.Fatalf("Expected the first trace to be cancelled, got %s", s)
+	}
+
+	if r.transition(second, traas2.StateProbing) {
+		t.Fatal("Expected a pending trace not to skip being triggered")
+	}
+	// The trace never probed, so has nothing to cancel.
+	if done := r.EndTrace(client); done == nil || done.ID != second.id || done.State != traas2.StateComplete {
+		t.Fatalf("Expected the trace to complete, got %+v", done)
+	}
+	if r.transition(second, traas2.StateCollecting) || r.transition(second, traas2.StateExpired) {
+		t.Fatal("Expected a complete trace to stay complete")
+	}
+}
+
+func TestStateTimeouts(t *testing.T) {
+	timeouts, err := StateTimeouts(Config{Timeouts: map[string]int{"pending": 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts[traas2.StatePending] != 5*time.Second || timeouts[traas2.StateCollecting] != defaultTimeouts[traas2.StateCollecting] {
+		t.Fatalf("Unexpected timeouts %v", timeouts)
+	}
+	for _, bad := range []map[string]int{{"complete": 5}, {"pending": 0}} {
+		if _, err := StateTimeouts(Config{Timeouts: bad}); err == nil {
+			t.Fatalf("Expected %v to be invalid", bad)
+		}
+	}
+}
+
+func TestRecorderClose(t *testing.T) {
+	conn := newChanConn(simServer, traas2.TraceLongestTTL)
+	clock := newFakeClock()
+	r := newRecorder(conn, simListeners, redirectProbe("./done", nil), false)
+	r.clock = clock
+	events, unsubscribe := r.Subscribe("")
+	defer unsubscribe()
+
+	r.BeginTrace(simClient, nil)
+	r.handlePacket(probeRequest(t, simClient, 5000))
+	<-conn.sent
+
+	// Probing stops without the clock moving.
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected closing not to wait for the clock")
+	}
+	if r.GetTrace(simClient) != nil {
+		t.Fatal("Expected the trace to end")
+	}
+	for s := nextState(t, events); s != traas2.StateCancelled; s = nextState(t, events) {
+		if s.Done() {
+			t.Fatalf("Expected the trace to be cancelled, got %s", s)
+		}
+	}
+	if len(conn.sent) >= probedTTLs-1 {
+		t.Fatal("Expected probing to stop when closed")
+	}
+}
+
+func TestExpiredTracesSaved(t *testing.T) {
+	clock := newFakeClock()
+	sink := &blockingSink{make(chan struct{}), make(chan *traas2.Trace, 1)}
+	close(sink.release)
+	s, err := New(WithConfig(Config{Path: "/traas"}), WithPacketConn(newChanConn(simServer, 1), 80), WithClock(clock), WithSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tr := s.listeners[0].recorder.BeginTrace(net.ParseIP("10.0.0.1"), nil)
+	clock.Advance(defaultTimeouts[traas2.StatePending] + time.Millisecond)
+	s.recorder.(*Recorder).reap()
+	select {
+	case written := <-sink.written:
+		if written.ID != tr.ID || written.State != traas2.StateExpired {
+			t.Fatalf("Expected the expired trace, got %+v", written)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the expired trace to be delivered to sinks")
+	}
+	if stored, _ := s.store.Get(tr.ID); stored == nil || stored.State != traas2.StateExpired {
+		t.Fatalf("Expected the expired trace to be stored, got %+v", stored)
+	}
+	if n := s.listeners[0].recorder.ActiveTraces(); n != 0 {
+		t.Fatalf("Expected the listener to stop tracking the trace, got %d", n)
+	}
+}
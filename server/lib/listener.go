@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/willscott/traas2"
+)
+
+// ListenerConfig is a frontend that clients reach traas through: the port
+// their connections arrive on, and the path traas is served at.
+type ListenerConfig struct {
+	ListenPort   uint16            // What port for pcap
+	Path         string            // What web path does traas live at
+	ProbeHeaders map[string]string // Headers added to the responses injected as probes
+	MaxTraces    int               // How many traces of the listener may run at once. Unlimited if unset.
+	Sinks        []SinkConfig      // Destinations for traces of the listener, as well as the server's sinks
+}
+
+// Listeners are the listeners of a configuration. Without any, traas is
+// served at Path to clients connecting to ListenPort.
+func Listeners(conf Config) []ListenerConfig {
+	if len(conf.Listeners) > 0 {
+		return conf.Listeners
+	}
+	return []ListenerConfig{{ListenPort: conf.ListenPort, Path: conf.Path, MaxTraces: conf.MaxTraces}}
+}
+
+// listenerPorts are the distinct ports of listeners.
+func listenerPorts(listeners []ListenerConfig) []uint16 {
+	var ports []uint16
+	seen := make(map[uint16]bool)
+	for _, l := range listeners {
+		if !seen[l.ListenPort] {
+			seen[l.ListenPort] = true
+			ports = append(ports, l.ListenPort)
+		}
+	}
+	return ports
+}
+
+// listenerEndpoint finds the endpoint of a listener that a request for path,
+// from a client connecting to port, was made to, or "" if it was to none.
+func listenerEndpoint(listeners []ListenerConfig, port uint16, path string) string {
+	matched, endpoint := -1, ""
+	for _, l := range listeners {
+		// the longest matching path wins, as with an http.ServeMux.
+		if l.ListenPort == port && strings.HasPrefix(path, l.Path+"/") && len(l.Path) > matched {
+			matched, endpoint = len(l.Path), strings.TrimPrefix(path, l.Path)
+		}
+	}
+	return endpoint
+}
+
+// probeHeaders formats headers for a probe response, in a stable order.
+func probeHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ": " + headers[name] + "\r\n")
+	}
+	return b.String()
+}
+
+// listenerRecorder is the part of a shared recorder a listener sees: the
+// traces begun through it. It is closed with the recorder, by the server.
+type listenerRecorder struct {
+	TraceRecorder
+	sync.Mutex
+	// traces are the IDs of the listener's traces, by client IP.
+	traces map[string]string
+}
+
+func newListenerRecorder(recorder TraceRecorder) *listenerRecorder {
+	return &listenerRecorder{TraceRecorder: recorder, traces: make(map[string]string)}
+}
+
+// owns checks if a trace was begun through the listener.
+func (l *listenerRecorder) owns(t *traas2.Trace) bool {
+	if t == nil {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.traces[t.To.String()] == t.ID
+}
+
+func (l *listenerRecorder) BeginTrace(to net.IP, probe *traas2.Probe) *traas2.Trace {
+	l.prune()
+	t := l.TraceRecorder.BeginTrace(to, probe)
+	l.Lock()
+	defer l.Unlock()
+	l.traces[to.String()] = t.ID
+	return t
+}
+
+func (l *listenerRecorder) GetTrace(to net.IP) *traas2.Trace {
+	if t := l.TraceRecorder.GetTrace(to); l.owns(t) {
+		return t
+	}
+	return nil
+}
+
+func (l *listenerRecorder) FindTrace(id string) *traas2.Trace {
+	if t := l.TraceRecorder.FindTrace(id); l.owns(t) {
+		return t
+	}
+	return nil
+}
+
+func (l *listenerRecorder) EndTrace(to net.IP) *traas2.Trace {
+	if l.GetTrace(to) == nil {
+		return nil
+	}
+	t := l.TraceRecorder.EndTrace(to)
+	if t != nil {
+		l.forget(to.String(), t.ID)
+	}
+	return t
+}
+
+// forget stops tracking a trace of the listener that has ended.
+func (l *listenerRecorder) forget(ip, id string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.traces[ip] == id {
+		delete(l.traces, ip)
+	}
+}
+
+// tracked copies the IDs of the listener's traces, by client IP.
+func (l *listenerRecorder) tracked() map[string]string {
+	l.Lock()
+	defer l.Unlock()
+	traces := make(map[string]string, len(l.traces))
+	for ip, id := range l.traces {
+		traces[ip] = id
+	}
+	return traces
+}
+
+// ActiveTraces counts the listener's traces still being recorded.
+func (l *listenerRecorder) ActiveTraces() int {
+	return l.prune()
+}
+
+// prune forgets the listener's traces that have ended, and counts those that haven't.
+func (l *listenerRecorder) prune() int {
+	n := 0
+	for ip, id := range l.tracked() {
+		if t := l.TraceRecorder.GetTrace(net.ParseIP(ip)); t != nil && t.ID == id {
+			n++
+		} else {
+			// the trace expired, or was replaced by one of another listener.
+			l.forget(ip, id)
+		}
+	}
+	return n
+}
+
+func (l *listenerRecorder) EndTraces() []*traas2.Trace {
+	var ended []*traas2.Trace
+	for ip := range l.tracked() {
+		if t := l.EndTrace(net.ParseIP(ip)); t != nil {
+			ended = append(ended, t)
+		}
+	}
+	return ended
+}
+
+// Close does nothing, as the shared recorder is closed by the server.
+func (l *listenerRecorder) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListeners(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "b.log")
+	conn := newChanConn(simServer, 1)
+	s, err := New(WithPacketConn(conn, 0),
+		WithListener(ListenerConfig{ListenPort: 80, Path: "/a", MaxTraces: 1, ProbeHeaders: map[string]string{"X-Tenant": "a"}}),
+		WithListener(ListenerConfig{ListenPort: 8080, Path: "/b", Sinks: []SinkConfig{{Type: "file", Target: log}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if want := "(icmp or (tcp dst port 80 or tcp dst port 8080))"; !strings.HasSuffix(conn.filter, want) {
+		t.Fatalf("Expected packets of both ports to be captured, got filter %q", conn.filter)
+	}
+	r := s.recorder.(*Recorder)
+	if !r.isProbeRequest(8080, []byte("GET /b/probe HTTP/1.1\r\n")) || r.isProbeRequest(8080, []byte("GET /c/probe HTTP/1.1\r\n")) {
+		t.Fatal("Expected the probe requests of listeners to trigger probes")
+	}
+	if r.isProbeRequest(80, []byte("GET /b/probe HTTP/1.1\r\n")) {
+		t.Fatal("Expected probe requests to a port of another listener not to trigger probes")
+	}
+
+	if w := get(s, "10.0.0.2", "/a/start"); w.Code != http.StatusFound || w.Header().Get("Location") != "/a/probe" {
+		t.Fatalf("Expected a redirect to probe, got %d %v", w.Code, w.Header())
+	}
+	a := r.active(net.ParseIP("10.0.0.2"))
+	if a == nil || !bytes.Contains(a.probe(nil).Payload, []byte("X-Tenant: a\r\n")) {
+		t.Fatal("Expected the trace to be probed with the headers of its listener")
+	}
+
+	// Limits are of each listener, whose traces are its own.
+	if w := get(s, "10.0.0.1", "/a/start"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a client beyond the limit to be turned away, got %d", w.Code)
+	}
+	if w := get(s, "10.0.0.1", "/b/start"); w.Code != http.StatusFound {
+		t.Fatalf("Expected another listener to admit the client, got %d", w.Code)
+	}
+	if w := get(s, "10.0.0.2", "/b/done"); w.Body.Len() != 0 || r.GetTrace(net.ParseIP("10.0.0.2")) == nil {
+		t.Fatalf("Expected a listener not to end the trace of another, got %q", w.Body)
+	}
+	b := r.GetTrace(net.ParseIP("10.0.0.1"))
+	if w := get(s, "10.0.0.1", "/b/done"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), b.ID) {
+		t.Fatalf("Expected the trace, got %d %q", w.Code, w.Body)
+	}
+	if w := get(s, "10.0.0.1", "/c/start"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected paths of no listener not to be served, got %d", w.Code)
+	}
+
+	// Traces are delivered to the sinks of their own listener.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logged, err := ioutil.ReadFile(log)
+	if err != nil || !strings.Contains(string(logged), b.ID) || strings.Contains(string(logged), a.id) {
+		t.Fatalf("Expected only the trace of the listener to be logged, got %q: %v", logged, err)
+	}
+}
+
+func TestListenersMaxTraces(t *testing.T) {
+	s, err := New(WithPacketConn(newChanConn(simServer, 1), 0), WithMaxTraces(1),
+		WithListener(ListenerConfig{ListenPort: 80, Path: "/a"}),
+		WithListener(ListenerConfig{ListenPort: 8080, Path: "/b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if w := get(s, "10.0.0.1", "/a/start"); w.Code != http.StatusFound {
+		t.Fatalf("Expected the client to be admitted, got %d", w.Code)
+	}
+	// The limit of the server is of the traces of all its listeners.
+	if w := get(s, "10.0.0.2", "/b/start"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a client beyond the limit to be turned away, got %d", w.Code)
+	}
+	if w := get(s, "10.0.0.1", "/b/start"); w.Code != http.StatusFound {
+		t.Fatalf("Expected a client restarting its trace to be admitted, got %d", w.Code)
+	}
+}
+
+func TestListenerEndpoint(t *testing.T) {
+	listeners := []ListenerConfig{{ListenPort: 80}, {ListenPort: 80, Path: "/a"}, {ListenPort: 81, Path: "/b"}}
+	for _, c := range []struct {
+		port     uint16
+		path     string
+		endpoint string
+	}{
+		{80, "/a/start", "/start"},
+		{80, "/b/start", "/b/start"},
+		{81, "/b/done", "/done"},
+		{81, "/a/done", ""},
+		{82, "/start", ""},
+	} {
+		if got := listenerEndpoint(listeners, c.port, c.path); got != c.endpoint {
+			t.Fatalf("Expected %s on port %d to be %q, got %q", c.path, c.port, c.endpoint, got)
+		}
+	}
+}
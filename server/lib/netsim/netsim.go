@@ -0,0 +1,269 @@
+// Package netsim simulates the network path between a traas server and a
+// client. Probes sent by the server are passed along a declared path of
+// routers, NATs and MPLS tunnels, which expire them and reply with ICMP as
+// real devices would, so that traces can be tested without a network.
+package netsim
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Node is a device on the path from the server to the client.
+type Node interface {
+	node()
+}
+
+// Router forwards probes, and replies with ICMP time exceeded to those that expire at it.
+type Router struct {
+	Addr      net.IP
+	Silent    bool // If the router never replies
+	RateLimit int  // Replies to only one of every RateLimit expiring probes, if set
+	Quote     int  // Bytes of expired probes quoted in replies. Default: the IP header and 8 bytes
+	expired   int
+}
+
+// Tunnel is a series of routers in an MPLS tunnel. Their replies carry the
+// tunnel's label stack as an RFC 4950 ICMP extension.
+type Tunnel struct {
+	Labels  []uint32
+	Routers []*Router
+}
+
+// NAT rewrites probes for a public address to a private one. Replies to
+// probes beyond the NAT have their quoted headers restored to the public
+// address, unless StaleQuotes is set.
+type NAT struct {
+	Public      net.IP
+	Private     net.IP
+	StaleQuotes bool
+}
+
+func (*Router) node() {}
+func (*Tunnel) node() {}
+func (*NAT) node()    {}
+
+// Network is the path from a server to a client, which acknowledges probes that reach it.
+type Network struct {
+	Path []Node
+	Loss float64 // Chance that a packet is lost at each node it passes
+	Seed int64   // Seed of the losses, so that they are the same each run
+	rng  *rand.Rand
+}
+
+// hop is a node of the path as seen by a probe, with tunnels expanded.
+type hop struct {
+	router *Router
+	nat    *NAT
+	labels []uint32
+}
+
+func (n *Network) hops() []hop {
+	var hops []hop
+	for _, node := range n.Path {
+		switch d := node.(type) {
+		case *Router:
+			hops = append(hops, hop{router: d})
+		case *NAT:
+			hops = append(hops, hop{nat: d})
+		case *Tunnel:
+			for _, r := range d.Routers {
+				hops = append(hops, hop{router: r, labels: d.Labels})
+			}
+		}
+	}
+	return hops
+}
+
+// lost decides if a packet is lost passing a node.
+func (n *Network) lost() bool {
+	if n.Loss == 0 {
+		return false
+	}
+	if n.rng == nil {
+		n.rng = rand.New(rand.NewSource(n.Seed))
+	}
+	return n.rng.Float64() < n.Loss
+}
+
+// Send passes a probe, an IPv4 packet sent by the server, along the path.
+// The packets the server receives as a result are returned.
+func (n *Network) Send(probe []byte) []gopacket.Packet {
+	packet := gopacket.NewPacket(probe, layers.LayerTypeIPv4, gopacket.Default)
+	ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil
+	}
+	hops := n.hops()
+
+	for i, h := range hops {
+		if n.lost() {
+			return nil
+		}
+		if h.nat != nil {
+			if ip.DstIP.Equal(h.nat.Public) {
+				ip.DstIP = h.nat.Private
+			}
+			continue
+		}
+		ip.TTL--
+		if ip.TTL > 0 {
+			continue
+		}
+		r := h.router
+		r.expired++
+		if r.Silent || (r.RateLimit > 1 && (r.expired-1)%r.RateLimit != 0) {
+			return nil
+		}
+		return n.expire(hops[:i], r, ip, h.labels)
+	}
+
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil
+	}
+	return n.acknowledge(hops, ip, tcp)
+}
+
+// returns passes a reply back across hops to the server. It reports the
+// number of routers passed, or false if the reply is lost.
+func (n *Network) returns(back []hop) (uint8, bool) {
+	var routers uint8
+	for _, h := range back {
+		if n.lost() {
+			return 0, false
+		}
+		if h.router != nil {
+			routers++
+		}
+	}
+	return routers, true
+}
+
+// public is the address that addr is rewritten to by the NATs on hops back to the server.
+func public(back []hop, addr net.IP, quoted bool) net.IP {
+	for i := len(back) - 1; i >= 0; i-- {
+		if nat := back[i].nat; nat != nil && addr.Equal(nat.Private) && !(quoted && nat.StaleQuotes) {
+			addr = nat.Public
+		}
+	}
+	return addr
+}
+
+// expire builds the ICMP time exceeded reply of router r to an expired probe.
+func (n *Network) expire(back []hop, r *Router, probe *layers.IPv4, labels []uint32) []gopacket.Packet {
+	routers, ok := n.returns(back)
+	if !ok {
+		return nil
+	}
+
+	quoted := *probe
+	quoted.DstIP = public(back, probe.DstIP, true)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &quoted, gopacket.Payload(probe.Payload)); err != nil {
+		return nil
+	}
+	quote := buf.Bytes()
+	length := int(quoted.IHL)*4 + 8
+	if r.Quote != 0 {
+		length = r.Quote
+	}
+	if length < len(quote) {
+		quote = quote[:length]
+	}
+
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}
+	if len(labels) > 0 {
+		// RFC 4884: the quote is padded to 128 bytes, and its length in words
+		// is given in the second byte of the otherwise unused header field.
+		if len(quote) > 128 {
+			quote = quote[:128]
+		}
+		quote = append(quote, make([]byte, 128-len(quote))...)
+		icmp.Id = uint16(len(quote) / 4)
+		quote = append(quote, mplsExtension(labels)...)
+	}
+
+	reply := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      255 - routers,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    r.Addr,
+		DstIP:    probe.SrcIP,
+	}
+	return serialize(reply, icmp, gopacket.Payload(quote))
+}
+
+// mplsExtension builds an RFC 4884 extension structure holding an RFC 4950 MPLS label stack.
+func mplsExtension(labels []uint32) []byte {
+	ext := []byte{0x20, 0, 0, 0}
+	obj := make([]byte, 4, 4+4*len(labels))
+	binary.BigEndian.PutUint16(obj[0:2], uint16(cap(obj)))
+	obj[2], obj[3] = 1, 1
+	for i, label := range labels {
+		entry := label<<12 | 1
+		if i == len(labels)-1 {
+			entry |= 0x100
+		}
+		obj = append(obj, byte(entry>>24), byte(entry>>16), byte(entry>>8), byte(entry))
+	}
+	ext = append(ext, obj...)
+	binary.BigEndian.PutUint16(ext[2:4], checksum(ext))
+	return ext
+}
+
+// checksum is the internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// acknowledge builds the client's acknowledgement of a probe that reached it.
+func (n *Network) acknowledge(back []hop, probe *layers.IPv4, tcp *layers.TCP) []gopacket.Packet {
+	routers, ok := n.returns(back)
+	if !ok {
+		return nil
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64 - routers,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    public(back, probe.DstIP, false),
+		DstIP:    probe.SrcIP,
+	}
+	ack := &layers.TCP{
+		SrcPort: tcp.DstPort,
+		DstPort: tcp.SrcPort,
+		Seq:     tcp.Ack,
+		Ack:     tcp.Seq + uint32(len(tcp.Payload)),
+		ACK:     true,
+		Window:  1024,
+	}
+	ack.SetNetworkLayerForChecksum(ip)
+	return serialize(ip, ack)
+}
+
+// serialize builds a packet received by the server from layers.
+func serialize(ls ...gopacket.SerializableLayer) []gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		return nil
+	}
+	return []gopacket.Packet{gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/willscott/traas2"
+	"github.com/willscott/traas2/server/lib/netsim"
+)
+
+var (
+	simServer = net.IPv4(192, 0, 2, 1).To4()
+	simClient = net.IPv4(203, 0, 113, 5).To4()
+	// simListeners serve traas at the root, to clients connecting to port 80.
+	simListeners = []ListenerConfig{{ListenPort: 80}}
+)
+
+// simulateTrace probes a client across a simulated network, as the recorder
+// does but without pacing, and records the replies.
+func simulateTrace(t *testing.T, network *netsim.Network) *traas2.Trace {
+	return simulateTraceRTT(t, network, 0)
+}
+
+// simulateTraceRTT is simulateTrace on a fake clock, where replies arrive rtt after probes are sent.
+func simulateTraceRTT(t *testing.T, network *netsim.Network, rtt time.Duration) *traas2.Trace {
+	clock := newFakeClock()
+	conn := newChanConn(simServer, traas2.TraceLongestTTL)
+	r := newRecorder(conn, simListeners, redirectProbe("./done", nil), false)
+	r.clock = clock
+	r.BeginTrace(simClient, nil)
+	trace := r.active(simClient)
+
+	request := probeRequest(t, simClient, 5000)
+	trace.trigger(5000, simServer, clock.Now(), nil)
+	SpoofProbe(context.Background(), conn, clock, r.probe, request, trace.setSent, false)
+
+	clock.Advance(rtt)
+	for len(conn.sent) > 0 {
+		for _, reply := range network.Send(<-conn.sent) {
+			r.handlePacket(reply)
+		}
+	}
+	return r.EndTrace(simClient)
+}
+
+// probeRequest is a client's request for its probes, whose replies have sequence number seq.
+func probeRequest(t *testing.T, client net.IP, seq uint32) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: simServer}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1000, Ack: seq, ACK: true, PSH: true}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, tcp, gopacket.Payload("GET /probe HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// checkRoute compares the addresses of a trace's hops, by TTL, with those expected.
+func checkRoute(t *testing.T, trace *traas2.Trace, want map[uint8]net.IP) {
+	t.Helper()
+	if len(trace.Route) != len(want) {
+		t.Fatalf("Expected %d hops, got %+v", len(want), trace.Route)
+	}
+	for _, hop := range trace.Route {
+		if !hop.IP.Equal(want[hop.TTL]) {
+			t.Fatalf("Expected %v at ttl %d, got %v", want[hop.TTL], hop.TTL, hop.IP)
+		}
+	}
+}
+
+func routers(n int, third byte) []*netsim.Router {
+	rs := make([]*netsim.Router, n)
+	for i := range rs {
+		rs[i] = &netsim.Router{Addr: net.IPv4(198, 51, third, byte(i+1)).To4()}
+	}
+	return rs
+}
+
+func TestSimulatedPath(t *testing.T) {
+	rs := routers(5, 100)
+	network := &netsim.Network{}
+	for _, r := range rs {
+		network.Path = append(network.Path, r)
+	}
+	trace := simulateTrace(t, network)
+	// probes begin at TraceShortestTTL, so the first routers are not seen.
+	checkRoute(t, trace, map[uint8]net.IP{4: rs[3].Addr, 5: rs[4].Addr})
+	if !trace.Reached || trace.Route[0].ReplyTTL != 252 {
+		t.Fatalf("Expected the client to be reached, got %+v", trace)
+	}
+}
+
+func TestSimulatedLatency(t *testing.T) {
+	network := &netsim.Network{}
+	for _, r := range routers(6, 100) {
+		network.Path = append(network.Path, r)
+	}
+	trace := simulateTraceRTT(t, network, 30*time.Millisecond)
+	if len(trace.Route) != 3 {
+		t.Fatalf("Expected 3 hops, got %+v", trace.Route)
+	}
+	for _, hop := range trace.Route {
+		if hop.Latency != 15*time.Millisecond {
+			t.Fatalf("Expected one way latency of 15ms, got %v at ttl %d", hop.Latency, hop.TTL)
+		}
+	}
+}
+
+func TestSimulatedNAT(t *testing.T) {
+	rs := routers(6, 100)
+	private := net.IPv4(10, 0, 0, 2).To4()
+	nat := &netsim.NAT{Public: simClient, Private: private}
+	network := &netsim.Network{Path: []netsim.Node{rs[0], rs[1], rs[2], rs[3], nat, rs[4], rs[5]}}
+	checkRoute(t, simulateTrace(t, network), map[uint8]net.IP{4: rs[3].Addr, 5: rs[4].Addr, 6: rs[5].Addr})
+
+	// Replies from behind a NAT that doesn't restore quoted headers can't be matched.
+	nat.StaleQuotes = true
+	checkRoute(t, simulateTrace(t, network), map[uint8]net.IP{4: rs[3].Addr})
+}
+
+func TestSimulatedQuotesAndLimits(t *testing.T) {
+	rs := routers(7, 100)
+	// A quote too short to hold the probe's IP header can't be matched, or
+	// decoded, while a quote of just the header is enough.
+	rs[3].Quote = 12
+	rs[4].Quote = 20
+	rs[5].Silent = true
+	rs[6].RateLimit = 2
+	network := &netsim.Network{}
+	for _, r := range rs {
+		network.Path = append(network.Path, r)
+	}
+	checkRoute(t, simulateTrace(t, network), map[uint8]net.IP{5: rs[4].Addr, 7: rs[6].Addr})
+}
+
+func TestSimulatedMPLS(t *testing.T) {
+	rs := routers(6, 100)
+	tunnel := &netsim.Tunnel{Labels: []uint32{16000, 24001}, Routers: rs[3:5]}
+	network := &netsim.Network{Path: []netsim.Node{rs[0], rs[1], rs[2], tunnel, rs[5]}}
+	trace := simulateTrace(t, network)
+	checkRoute(t, trace, map[uint8]net.IP{4: rs[3].Addr, 5: rs[4].Addr, 6: rs[5].Addr})
+	ext := trace.Route[0].Extensions
+	if len(ext) != 1 || len(ext[0].MPLS) != 2 || ext[0].MPLS[0].Label != 16000 || !ext[0].MPLS[1].S {
+		t.Fatalf("Expected the tunnel's label stack, got %+v", ext)
+	}
+	if len(trace.Route[2].Extensions) != 0 {
+		t.Fatalf("Expected no labels beyond the tunnel, got %+v", trace.Route[2].Extensions)
+	}
+}
+
+func TestSimulatedLoss(t *testing.T) {
+	path := func() *netsim.Network {
+		network := &netsim.Network{Loss: 0.05, Seed: 7}
+		for _, r := range routers(20, 100) {
+			network.Path = append(network.Path, r)
+		}
+		return network
+	}
+	first, second := simulateTrace(t, path()), simulateTrace(t, path())
+	if len(first.Route) == 0 || len(first.Route) >= 17 {
+		t.Fatalf("Expected some, but not all, hops to be lost, got %d", len(first.Route))
+	}
+	if len(first.Route) != len(second.Route) {
+		t.Fatalf("Expected loss to be deterministic, got %d then %d hops", len(first.Route), len(second.Route))
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// defaultStoreSize is how many completed traces are kept in memory if not configured.
+const defaultStoreSize = 1000
+
+// defaultStoreTTL is how many seconds completed traces are kept if not configured.
+const defaultStoreTTL = 7 * 24 * 60 * 60
+
+// Option configures a Server created by New.
+type Option func(*options)
+
+type options struct {
+	conf     Config
+	conn     PacketConn
+	recorder TraceRecorder
+	store    Store
+	sinks    []TraceSink
+	timeouts map[traas2.State]time.Duration
+	clock    Clock
+}
+
+// WithConfig configures the server as conf does. Later options override its values.
+func WithConfig(conf Config) Option {
+	return func(o *options) { o.conf = conf }
+}
+
+// WithPath serves traas below a path, like "/traas".
+func WithPath(path string) Option {
+	return func(o *options) { o.conf.Path = path }
+}
+
+// WithIPHeader reads client IPs from an HTTP header, like X-Forwarded-For, set by a proxy in front of the server.
+func WithIPHeader(header string) Option {
+	return func(o *options) { o.conf.IPHeader = header }
+}
+
+// WithPacketConn records traces from the packets of conn, and sends probes
+// with it. port is the TCP port clients connect to, as seen in captured
+// packets, unless listeners are given. The server closes conn when it is closed.
+func WithPacketConn(conn PacketConn, port uint16) Option {
+	return func(o *options) {
+		o.conn = conn
+		o.conf.ListenPort = port
+	}
+}
+
+// WithRecorder records traces with recorder, in place of a packet connection.
+// The server closes recorder when it is closed.
+func WithRecorder(recorder TraceRecorder) Option {
+	return func(o *options) { o.recorder = recorder }
+}
+
+// WithStore keeps completed traces in store, in place of the configured store.
+// The server closes store when it is closed.
+func WithStore(store Store) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithSink delivers completed traces to sink, as well as to the configured sinks.
+// The server closes sink when it is closed.
+func WithSink(sink TraceSink) Option {
+	return func(o *options) { o.sinks = append(o.sinks, sink) }
+}
+
+// WithStoreLimits keeps up to size completed traces in memory, for up to ttl.
+func WithStoreLimits(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.conf.StoreSize = size
+		o.conf.StoreTTL = int(ttl / time.Second)
+	}
+}
+
+// WithMaxTraces limits how many traces may run at once. Clients starting
+// traces beyond the limit are turned away. With listeners, the limit is of
+// the traces of all of them, as well as the limit of each listener.
+func WithMaxTraces(n int) Option {
+	return func(o *options) { o.conf.MaxTraces = n }
+}
+
+// WithListener serves traas through a listener, in addition to those already
+// given. A server with listeners is not served at its own path and port.
+func WithListener(l ListenerConfig) Option {
+	return func(o *options) { o.conf.Listeners = append(o.conf.Listeners, l) }
+}
+
+// WithTimeouts sets how long traces may stay in each state before they expire.
+// States without a timeout keep the default.
+func WithTimeouts(timeouts map[traas2.State]time.Duration) Option {
+	return func(o *options) { o.timeouts = timeouts }
+}
+
+// WithClock times traces with clock.
+func WithClock(clock Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// New creates a traas server configured by opts. The server is an
+// http.Handler of the traas endpoints below the path of each listener, which
+// can be mounted in another server's mux, or run by itself with Serve. Traces
+// of all listeners are recorded from one packet connection, or by a recorder,
+// one of which must be given. Close or Shutdown release everything the server
+// was given or opened.
+func New(opts ...Option) (*Server, error) {
+	o := options{clock: SystemClock}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	conf := o.conf
+	if conf.StoreSize == 0 {
+		conf.StoreSize = defaultStoreSize
+	}
+	if conf.StoreTTL == 0 {
+		conf.StoreTTL = defaultStoreTTL
+	}
+	timeouts, err := StateTimeouts(conf)
+	if err != nil {
+		return nil, err
+	}
+	for state, d := range o.timeouts {
+		if _, ok := timeouts[state]; !ok || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %v for trace state %q", d, state)
+		}
+		timeouts[state] = d
+	}
+
+	listeners := Listeners(conf)
+	paths := make(map[string]bool)
+	for _, l := range listeners {
+		if paths[l.Path] {
+			return nil, fmt.Errorf("listeners share the path %q", l.Path)
+		}
+		paths[l.Path] = true
+	}
+
+	recorder := o.recorder
+	if recorder == nil {
+		if o.conn == nil {
+			return nil, errors.New("a packet connection or recorder is needed")
+		}
+		for _, l := range listeners {
+			if l.ListenPort == 0 {
+				return nil, fmt.Errorf("the port clients of %q connect to is needed", l.Path)
+			}
+		}
+		r := newRecorder(o.conn, listeners, redirectProbe("./done", nil), conf.Debug)
+		r.timeouts = timeouts
+		r.clock = o.clock
+		recorder = r
+	}
+
+	store := o.store
+	if store == nil {
+		store = NewMemoryStore(conf.StoreSize, time.Duration(conf.StoreTTL)*time.Second, o.clock)
+		if conf.Database != "" {
+			if store, err = OpenBoltStore(conf.Database, time.Duration(conf.StoreTTL)*time.Second, o.clock, false); err != nil {
+				recorder.Close()
+				return nil, fmt.Errorf("could not open trace database: %v", err)
+			}
+		}
+	}
+	sinks, err := OpenSinks(conf)
+	if err != nil {
+		recorder.Close()
+		store.Close()
+		return nil, fmt.Errorf("could not open trace sinks: %v", err)
+	}
+	for i, sink := range o.sinks {
+		sinks.add(fmt.Sprintf("option %d", i), sink, TraceFilter{}, 0)
+	}
+
+	s := &Server{
+		config:       conf,
+		clock:        o.clock,
+		probeTimeout: timeouts[traas2.StateTriggered] + timeouts[traas2.StateProbing],
+		recorder:     recorder,
+		store:        store,
+		sinks:        sinks,
+		mux:          http.NewServeMux(),
+		stopping:     make(chan struct{}),
+	}
+	for _, lc := range listeners {
+		l, err := s.listen(lc)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not open sinks of %q: %v", lc.Path, err)
+		}
+		s.listeners = append(s.listeners, l)
+		s.mux.Handle(lc.Path+"/", l.mux)
+	}
+	// The recorder starts once expired traces can be saved.
+	if r, ok := recorder.(*Recorder); ok && o.recorder == nil {
+		r.expired = s.saveExpired
+		if err := r.start(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.webServer = http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", conf.ServePort), Handler: s}
+	return s, nil
+}
+
+// listen creates the server of a listener, sharing the recorder and store of s.
+func (s *Server) listen(lc ListenerConfig) (*Server, error) {
+	conf := s.config
+	conf.ListenPort, conf.Path, conf.MaxTraces = lc.ListenPort, lc.Path, lc.MaxTraces
+	conf.Sinks, conf.TraceLog, conf.Listeners = lc.Sinks, nil, nil
+	sinks, err := OpenSinks(conf)
+	if err != nil {
+		return nil, err
+	}
+	l := &Server{
+		config:       conf,
+		probe:        redirectProbe("./done", lc.ProbeHeaders),
+		clock:        s.clock,
+		probeTimeout: s.probeTimeout,
+		formatProbes: make(map[string]*traas2.Probe),
+		recorder:     newListenerRecorder(s.recorder),
+		store:        s.store,
+		sinks:        sinks,
+		parent:       s,
+	}
+	for format := range formatTypes {
+		l.formatProbes[format] = redirectProbe("./done?format="+format, lc.ProbeHeaders)
+	}
+	l.mux = l.routes()
+	return l, nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// get runs a request from a client through a handler.
+func get(h http.Handler, client, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = client + ":40000"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestEmbeddedServers(t *testing.T) {
+	// Two servers live in one process, each on its own packet connection and path.
+	conns := []*chanConn{newChanConn(simServer, 1), newChanConn(simServer, 1)}
+	mux := http.NewServeMux()
+	var servers []*Server
+	for i, path := range []string{"/a", "/b"} {
+		s, err := New(WithPacketConn(conns[i], 80), WithPath(path), WithMaxTraces(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if !strings.Contains(conns[i].filter, "port 80") {
+			t.Fatalf("Expected packets of port 80 to be captured, got filter %q", conns[i].filter)
+		}
+		mux.Handle(path+"/", s)
+		servers = append(servers, s)
+	}
+
+	if w := get(mux, "10.0.0.1", "/a/start"); w.Code != http.StatusFound || w.Header().Get("Location") != "/a/probe" {
+		t.Fatalf("Expected a redirect to probe, got %d %v", w.Code, w.Header())
+	}
+	if servers[0].recorder.ActiveTraces() != 1 || servers[1].recorder.ActiveTraces() != 0 {
+		t.Fatal("Expected the trace to be kept by the server it began on")
+	}
+
+	// Each server has its own limit, which a client restarting its trace is not held to.
+	if w := get(mux, "10.0.0.2", "/a/start"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a client beyond the limit to be turned away, got %d", w.Code)
+	}
+	if w := get(mux, "10.0.0.1", "/a/start"); w.Code != http.StatusFound {
+		t.Fatalf("Expected a client to restart its trace, got %d", w.Code)
+	}
+	if w := get(mux, "10.0.0.2", "/b/start"); w.Code != http.StatusFound {
+		t.Fatalf("Expected another server to admit the client, got %d", w.Code)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatal("Expected a server without a packet connection or recorder to fail")
+	}
+	if _, err := New(WithPacketConn(newChanConn(simServer, 1), 0)); err == nil {
+		t.Fatal("Expected a server without a port to fail")
+	}
+	rec := newFakeRecorder()
+	s, err := New(WithRecorder(rec), WithStoreLimits(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.config.StoreSize != 10 || s.config.StoreTTL != defaultStoreTTL {
+		t.Fatalf("Expected store limits to be set with defaults, got %+v", s.config)
+	}
+	if err := s.Close(); err != nil || !rec.closed {
+		t.Fatal("Expected the recorder to be closed with the server")
+	}
+
+	// Clients wait for probes as long as traces may be triggered and probing.
+	s, err = New(WithRecorder(newFakeRecorder()), WithTimeouts(map[traas2.State]time.Duration{traas2.StateProbing: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if want := defaultTimeouts[traas2.StateTriggered] + time.Minute; s.listeners[0].probeTimeout != want {
+		t.Fatalf("Expected clients to wait %v for probes, got %v", want, s.listeners[0].probeTimeout)
+	}
+}
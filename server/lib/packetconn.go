@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// PacketWriter sends serialized IPv4 packets.
+type PacketWriter interface {
+	WritePacket(packet []byte) error
+}
+
+// PacketConn is the packet backend of a recorder: it captures the packets
+// traces are recorded from, and sends probes.
+type PacketConn interface {
+	PacketWriter
+	// Addrs are the IPv4 addresses of the server, which probes are sent from.
+	Addrs() []net.IP
+	// SetFilter limits captured packets to those matching a BPF filter.
+	SetFilter(filter string) error
+	// Packets returns captured packets. The channel is closed when the connection is.
+	Packets() <-chan gopacket.Packet
+	// ReplyWriter sends packets out of the interface a captured packet arrived on.
+	ReplyWriter(to gopacket.Packet) PacketWriter
+	// Close stops capturing and sending packets.
+	Close() error
+}
+
+// DeviceConfig is a network interface that packets are captured on and sent from.
+type DeviceConfig struct {
+	Device    string   // What network interface is listened to
+	Dst       string   // Ethernet address of the gateway network interface
+	Addresses []string // IPv4 addresses clients reach the server at on the device. All of those of the device if unset.
+}
+
+// Devices are the devices of a configuration. Without any, packets are
+// captured on Device, and sent to the gateway at Dst.
+func Devices(conf Config) []DeviceConfig {
+	if len(conf.Devices) > 0 {
+		return conf.Devices
+	}
+	return []DeviceConfig{{Device: conf.Device, Dst: conf.Dst}}
+}
+
+// deviceAddrs are the IPv4 addresses of a device: those configured, or else those of its interface.
+func deviceAddrs(dc DeviceConfig) ([]net.IP, error) {
+	if len(dc.Addresses) == 0 {
+		return deviceIPv4s(dc.Device)
+	}
+	addrs := make([]net.IP, len(dc.Addresses))
+	for i, a := range dc.Addresses {
+		if addrs[i] = net.ParseIP(a).To4(); addrs[i] == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 address", a)
+		}
+	}
+	return addrs, nil
+}
+
+// deviceIPv4s finds the IPv4 addresses of a network device.
+func deviceIPv4s(netDev string) ([]net.IP, error) {
+	ief, err := net.InterfaceByName(netDev)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ief.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IPv4 Address on Interface")
+	}
+	return ips, nil
+}
+
+// pcapDevice captures and sends packets on a network device with pcap.
+type pcapDevice struct {
+	index      int
+	capture    *pcap.Handle
+	send       *pcap.Handle
+	addrs      []net.IP
+	linkHeader []byte
+}
+
+func openPcapDevice(dc DeviceConfig) (*pcapDevice, error) {
+	iface, err := net.InterfaceByName(dc.Device)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := deviceAddrs(dc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", dc.Device, err)
+	}
+	dst, err := hex.DecodeString(dc.Dst)
+	if err != nil || len(dst) != 6 {
+		return nil, fmt.Errorf("%q is not an ethernet address", dc.Dst)
+	}
+
+	d := &pcapDevice{index: iface.Index, addrs: addrs}
+	d.linkHeader = append(dst, []byte(iface.HardwareAddr)...)
+	d.linkHeader = append(d.linkHeader, 0x08, 0) // IPv4 EtherType
+	if d.capture, err = pcap.OpenLive(dc.Device, 2048, false, pcap.BlockForever); err != nil {
+		return nil, err
+	}
+	if d.send, err = pcap.OpenLive(dc.Device, 2048, false, pcap.BlockForever); err != nil {
+		d.capture.Close()
+		return nil, err
+	}
+	// make sure the handle doesn't queue up packets and start blocking / dying
+	d.send.SetBPFFilter("ip.len > 5000")
+	return d, nil
+}
+
+func (d *pcapDevice) WritePacket(packet []byte) error {
+	frame := make([]byte, 0, len(d.linkHeader)+len(packet))
+	frame = append(append(frame, d.linkHeader...), packet...)
+	return d.send.WritePacketData(frame)
+}
+
+func (d *pcapDevice) close() {
+	d.capture.Close()
+	d.send.Close()
+}
+
+// pcapConn captures packets on every device into one stream. Captured
+// packets are marked with the index of the interface they arrived on.
+type pcapConn struct {
+	devices []*pcapDevice
+	packets chan gopacket.Packet
+	done    chan struct{}
+	closing sync.Once
+}
+
+// OpenPcap opens a packet connection on network devices. Packets from each
+// device are sent to its gateway.
+func OpenPcap(devices []DeviceConfig) (PacketConn, error) {
+	if len(devices) == 0 {
+		return nil, errors.New("no device to capture on")
+	}
+	c := &pcapConn{packets: make(chan gopacket.Packet), done: make(chan struct{})}
+	for _, dc := range devices {
+		d, err := openPcapDevice(dc)
+		if err != nil {
+			for _, opened := range c.devices {
+				opened.close()
+			}
+			return nil, err
+		}
+		c.devices = append(c.devices, d)
+	}
+
+	var capturing sync.WaitGroup
+	for _, d := range c.devices {
+		capturing.Add(1)
+		go func(d *pcapDevice) {
+			defer capturing.Done()
+			for packet := range gopacket.NewPacketSource(d.capture, d.capture.LinkType()).Packets() {
+				packet.Metadata().InterfaceIndex = d.index
+				select {
+				case c.packets <- packet:
+				case <-c.done:
+				}
+			}
+		}(d)
+	}
+	go func() {
+		capturing.Wait()
+		close(c.packets)
+	}()
+	return c, nil
+}
+
+func (c *pcapConn) Addrs() []net.IP {
+	var addrs []net.IP
+	for _, d := range c.devices {
+		addrs = append(addrs, d.addrs...)
+	}
+	return addrs
+}
+
+func (c *pcapConn) SetFilter(filter string) error {
+	for _, d := range c.devices {
+		if err := d.capture.SetBPFFilter(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *pcapConn) Packets() <-chan gopacket.Packet {
+	return c.packets
+}
+
+// WritePacket sends a packet out of the device with its source address.
+func (c *pcapConn) WritePacket(packet []byte) error {
+	var src net.IP
+	if len(packet) >= 20 {
+		src = net.IP(packet[12:16])
+	}
+	return c.deviceOf(src).WritePacket(packet)
+}
+
+// ReplyWriter is the device a packet was captured on, or else the device with its destination address.
+func (c *pcapConn) ReplyWriter(to gopacket.Packet) PacketWriter {
+	for _, d := range c.devices {
+		if d.index == to.Metadata().InterfaceIndex {
+			return d
+		}
+	}
+	if network := to.NetworkLayer(); network != nil {
+		return c.deviceOf(net.IP(network.NetworkFlow().Dst().Raw()))
+	}
+	return c.devices[0]
+}
+
+// deviceOf is the device with an address, or the first device if none has it.
+func (c *pcapConn) deviceOf(addr net.IP) *pcapDevice {
+	for _, d := range c.devices {
+		for _, a := range d.addrs {
+			if a.Equal(addr) {
+				return d
+			}
+		}
+	}
+	return c.devices[0]
+}
+
+func (c *pcapConn) Close() error {
+	c.closing.Do(func() {
+		close(c.done)
+		for _, d := range c.devices {
+			d.close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// chanConn is a PacketConn whose packets are given by tests, and whose sent packets are kept in a channel.
+type chanConn struct {
+	addr    net.IP
+	packets chan gopacket.Packet
+	sent    chan []byte
+	filter  string
+	closing sync.Once
+}
+
+func newChanConn(addr net.IP, size int) *chanConn {
+	return &chanConn{addr: addr, packets: make(chan gopacket.Packet, size), sent: make(chan []byte, size)}
+}
+
+func (c *chanConn) Addrs() []net.IP                             { return []net.IP{c.addr} }
+func (c *chanConn) SetFilter(filter string) error               { c.filter = filter; return nil }
+func (c *chanConn) Packets() <-chan gopacket.Packet             { return c.packets }
+func (c *chanConn) ReplyWriter(to gopacket.Packet) PacketWriter { return c }
+
+func (c *chanConn) Close() error {
+	c.closing.Do(func() { close(c.packets) })
+	return nil
+}
+
+func (c *chanConn) WritePacket(packet []byte) error {
+	c.sent <- packet
+	return nil
+}
+
+func TestRecorderFilter(t *testing.T) {
+	if got, want := recorderFilter([]net.IP{simServer}, 80), "dst host 192.0.2.1 and (icmp or (tcp dst port 80))"; got != want {
+		t.Fatalf("Expected filter %q, got %q", want, got)
+	}
+	vip := net.IPv4(198, 51, 100, 1).To4()
+	got := recorderFilter([]net.IP{simServer, vip}, 80, 8080)
+	if want := "(dst host 192.0.2.1 or dst host 198.51.100.1) and (icmp or (tcp dst port 80 or tcp dst port 8080))"; got != want {
+		t.Fatalf("Expected filter %q, got %q", want, got)
+	}
+}
+
+func TestDeviceRouting(t *testing.T) {
+	vip := net.IPv4(198, 51, 100, 1).To4()
+	eth0 := &pcapDevice{index: 2, addrs: []net.IP{simServer}}
+	eth1 := &pcapDevice{index: 3, addrs: []net.IP{vip}}
+	c := &pcapConn{devices: []*pcapDevice{eth0, eth1}}
+	if addrs := c.Addrs(); len(addrs) != 2 || !addrs[1].Equal(vip) {
+		t.Fatalf("Expected the addresses of every device, got %v", addrs)
+	}
+
+	// Replies leave from the interface their request arrived on, even if it is
+	// to an address of another.
+	request := probeRequest(t, simClient, 5000)
+	request.Metadata().InterfaceIndex = eth1.index
+	if w := c.ReplyWriter(request); w != eth1 {
+		t.Fatal("Expected the reply to leave from the interface of the request")
+	}
+	// Without one, replies leave from the interface with the request's address.
+	request.Metadata().InterfaceIndex = 0
+	if w := c.ReplyWriter(request); w != eth0 {
+		t.Fatal("Expected the reply to leave from the interface with its address")
+	}
+	if c.deviceOf(vip) != eth1 || c.deviceOf(simClient) != eth0 {
+		t.Fatal("Expected packets to leave from the interface with their source address")
+	}
+
+	if _, err := deviceAddrs(DeviceConfig{Device: "eth1", Addresses: []string{"198.51.100.1", "2001:db8::1"}}); err == nil {
+		t.Fatal("Expected addresses to be IPv4")
+	}
+	if devices := Devices(Config{Device: "eth0", Dst: "00163e000001"}); len(devices) != 1 || devices[0].Device != "eth0" {
+		t.Fatalf("Expected the configured device, got %+v", devices)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/willscott/traas2"
+	"github.com/willscott/traas2/server/lib/netsim"
+)
+
+// TestConcurrentTraces records many traces at once while they are read, and
+// is meant for the race detector: go test -race.
+func TestConcurrentTraces(t *testing.T) {
+	const clients, rounds = 16, 4
+	conn := newChanConn(simServer, clients*probedTTLs)
+
+	clock := newFakeClock()
+	r := newRecorder(conn, simListeners, redirectProbe("./done", nil), false)
+	r.clock = clock
+	network := &netsim.Network{}
+	for _, router := range routers(8, 100) {
+		network.Path = append(network.Path, router)
+	}
+
+	requests := make([][]gopacket.Packet, clients)
+	for i := range requests {
+		for j := 0; j < rounds; j++ {
+			requests[i] = append(requests[i], probeRequest(t, net.IPv4(203, 0, 113, byte(i+1)).To4(), uint32(5000*(j+1))))
+		}
+	}
+
+	// Packets are handled in one goroutine, as they are captured.
+	packets := make(chan gopacket.Packet, clients*probedTTLs)
+	captured := make(chan struct{})
+	go func() {
+		defer close(captured)
+		for packet := range packets {
+			r.handlePacket(packet)
+		}
+	}()
+	// The network replies to probes.
+	stop := make(chan struct{})
+	replied := make(chan struct{})
+	go func() {
+		defer close(replied)
+		for {
+			select {
+			case probe := <-conn.sent:
+				for _, reply := range network.Send(probe) {
+					packets <- reply
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// Time passes, pacing probes and expiring traces.
+	ticked := make(chan struct{})
+	go func() {
+		defer close(ticked)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				clock.Advance(probeInterval)
+				r.reap()
+				runtime.Gosched()
+			}
+		}
+	}()
+	// Events are read as they are published.
+	events, unsubscribe := r.Subscribe("")
+	defer unsubscribe()
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				json.Marshal(ev)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var ended []*traas2.Trace
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(requests []gopacket.Packet) {
+			defer wg.Done()
+			ip := requests[0].NetworkLayer().NetworkFlow().Src().Raw()
+			for _, request := range requests {
+				begun := r.BeginTrace(ip, nil)
+				packets <- request
+				for j := 0; j < 20; j++ {
+					if tr := r.GetTrace(ip); tr != nil {
+						json.Marshal(tr)
+					}
+					r.FindTrace(begun.ID)
+					runtime.Gosched()
+				}
+				if tr := r.EndTrace(ip); tr != nil {
+					lock.Lock()
+					ended = append(ended, tr)
+					lock.Unlock()
+				}
+			}
+		}(requests[i])
+	}
+	wg.Wait()
+	r.probing.Wait()
+	close(stop)
+	<-replied
+	<-ticked
+	close(packets)
+	<-captured
+
+	if len(ended) == 0 {
+		t.Fatal("Expected some traces to complete")
+	}
+	for _, tr := range ended {
+		if tr.State != traas2.StateComplete || !sort.IsSorted(tr.Route) {
+			t.Fatalf("Expected a complete trace with a sorted route, got %+v", tr)
+		}
+	}
+}
@@ -3,181 +3,484 @@ package server
 import (
 	"bytes"
 	"context"
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	cmap "github.com/orcaman/concurrent-map"
 	"github.com/willscott/traas2"
 )
 
+// TraceRecorder records the traces run by a Server. Recorder records them from
+// captured packets, and can be replaced, as in tests. Traces returned are
+// snapshots, which are not changed as recording continues.
+type TraceRecorder interface {
+	// BeginTrace starts recording a trace of the client at an IP, probed with probe, or a default if nil.
+	BeginTrace(to net.IP, probe *traas2.Probe) *traas2.Trace
+	// GetTrace returns the active trace of the client at an IP, if any.
+	GetTrace(to net.IP) *traas2.Trace
+	// FindTrace returns the active trace with an ID, if any.
+	FindTrace(id string) *traas2.Trace
+	// EndTrace stops recording the trace of the client at an IP, and returns it.
+	EndTrace(to net.IP) *traas2.Trace
+	// ActiveTraces counts the traces being recorded.
+	ActiveTraces() int
+	// EndTraces stops recording every active trace, and returns them.
+	EndTraces() []*traas2.Trace
+	// Subscribe returns events of the trace with an ID, or of all traces if id is empty.
+	Subscribe(id string) (<-chan traas2.Event, func())
+	// Close stops recording, cancelling active traces.
+	Close() error
+}
+
 // Recorder is the state of the pcap listener.
 // Use begintrace / endTrace to interact with it, and let it know which packets it's watching for.
 type Recorder struct {
-	handle   *pcap.Handle
-	path     string
-	parser   *gopacket.DecodingLayerParser
-	handlers cmap.ConcurrentMap
-	probe    *traas2.Probe
-	debug    bool
-}
-
-// MakeRecorder initializes the system / pcap listening thread for a given device.
-func MakeRecorder(netDev string, path string, port uint16, probe *traas2.Probe, debug bool) (*Recorder, error) {
-	handle, err := pcap.OpenLive(netDev, 2048, false, pcap.BlockForever)
-	if err != nil {
+	conn      PacketConn
+	listeners []ListenerConfig // Frontends traas is served through, whose probe requests trigger probes
+	parser    *gopacket.DecodingLayerParser
+	handlers  cmap.ConcurrentMap
+	probe     *traas2.Probe
+	debug     bool
+	events    *eventBus
+	addrs     []net.IP // Addresses of the server, that clients connect to
+	offline   bool     // If packets are replayed from a capture, rather than probes sent
+	clock     Clock
+	// timeouts are how long traces may stay in each state before they expire.
+	timeouts map[traas2.State]time.Duration
+	// expired is given each trace that expires, if set.
+	expired func(*traas2.Trace)
+	// probing counts the goroutines sending and timing out probes.
+	probing sync.WaitGroup
+	// running counts the goroutines capturing packets and expiring traces, which stop once done is closed.
+	running   sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MakeRecorder starts recording traces of clients of listeners, from the
+// packets of conn. The recorder owns conn, and closes it when closed. Traces
+// expire after the timeouts of their states.
+func MakeRecorder(conn PacketConn, listeners []ListenerConfig, probe *traas2.Probe, debug bool, timeouts map[traas2.State]time.Duration) (*Recorder, error) {
+	recorder := newRecorder(conn, listeners, probe, debug)
+	recorder.timeouts = timeouts
+	if err := recorder.start(); err != nil {
 		return nil, err
 	}
+	return recorder, nil
+}
 
-	ipv4Layer := new(layers.IPv4)
-	ipv4Parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, ipv4Layer)
-
-	ief, err := net.InterfaceByName(netDev)
-	if err != nil {
-		return nil, err
+// start captures the packets of clients of the recorder's listeners, and expires traces.
+func (r *Recorder) start() error {
+	//TODO: ICMP?
+	filter := recorderFilter(r.addrs, listenerPorts(r.listeners)...)
+	if r.debug {
+		log.Printf("Capturing packets to %v with filter %s\n", r.addrs, filter)
 	}
-	addrs, err := ief.Addrs()
-	if err != nil || len(addrs) == 0 {
-		return nil, err
+	if err := r.conn.SetFilter(filter); err != nil {
+		return err
 	}
+	r.running.Add(2)
+	go r.watch(r.conn.Packets())
+	go r.reapTraces()
+	return nil
+}
 
-	addrIdx := 0
-	for addrs[addrIdx].(*net.IPNet).IP.To4() == nil {
-		addrIdx++
-		if addrIdx >= len(addrs) {
-			return nil, errors.New("no IPv4 Address on Interface")
-		}
+// newRecorder creates a recorder of packets from conn, triggered by probe
+// requests to listeners. Without a conn, as when replaying captures, no
+// packets are captured or sent.
+func newRecorder(conn PacketConn, listeners []ListenerConfig, probe *traas2.Probe, debug bool) *Recorder {
+	var addrs []net.IP
+	if conn != nil {
+		addrs = conn.Addrs()
 	}
-	src := addrs[addrIdx].(*net.IPNet).IP
-	fmt.Printf("Using source of %v\n", src)
-
-	recorder := &Recorder{handle, path, ipv4Parser, cmap.New(), probe, debug}
-
-	//TODO: ICMP?
-	fmt.Printf("dst host %s and (icmp or (tcp dst port %d))", src.String(), port)
-	err = handle.SetBPFFilter(fmt.Sprintf("dst host %s and (icmp or (tcp dst port %d))", src.String(), port))
-	if err != nil {
-		panic(err)
+	ipv4Layer := new(layers.IPv4)
+	ipv4Parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, ipv4Layer)
+	return &Recorder{
+		conn:      conn,
+		listeners: listeners,
+		parser:    ipv4Parser,
+		handlers:  cmap.New(),
+		probe:     probe,
+		debug:     debug,
+		events:    newEventBus(),
+		addrs:     addrs,
+		clock:     SystemClock,
+		timeouts:  defaultTimeouts,
+		done:      make(chan struct{}),
 	}
+}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	go recorder.watch(packetSource)
-
-	return recorder, nil
+// recorderFilter is the BPF filter of packets recorded for a server at addrs, listening on ports.
+func recorderFilter(addrs []net.IP, ports ...uint16) string {
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = "dst host " + addr.String()
+	}
+	host := strings.Join(hosts, " or ")
+	if len(hosts) > 1 {
+		host = "(" + host + ")"
+	}
+	tcp := make([]string, len(ports))
+	for i, port := range ports {
+		tcp[i] = fmt.Sprintf("tcp dst port %d", port)
+	}
+	return fmt.Sprintf("%s and (icmp or (%s))", host, strings.Join(tcp, " or "))
 }
 
-func (r *Recorder) watch(incoming *gopacket.PacketSource) error {
-	for packet := range incoming.Packets() {
+func (r *Recorder) watch(incoming <-chan gopacket.Packet) error {
+	defer r.running.Done()
+	for packet := range incoming {
 		if packet == nil {
 			return nil
 		}
+		r.handlePacket(packet)
+	}
+	return nil
+}
 
-		//TODO: v6
-		ipFrame, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		if !ok {
-			continue
-		}
-		//icmp
-		if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
-			if packet.Layer(layers.LayerTypeICMPv4) != nil {
-				icmpframe := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
-				// TODO: should other ICMP codes also be handled?
-				if icmpframe.TypeCode.Type() == layers.ICMPv4TypeTimeExceeded {
-					original := gopacket.NewPacket(icmpframe.Payload, layers.LayerTypeIPv4, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
-					v4 := original.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-					if v4 != nil {
-						if handler, ok := r.handlers.Get(v4.DstIP.String()); ok {
-							//fmt.Printf("Matched icmp to handler.\n")
-							trace := handler.(*traas2.Trace)
-
-							// see if we got anything interesting in packet options
-							for _, opt := range v4.Options {
-								if opt.OptionType == 7 {
-									log.Printf("route recording got us %x", opt.OptionData)
-								} else if opt.OptionType == 4 {
-									log.Printf("timestamp got us %x", opt.OptionData)
-								}
-							}
+// handlePacket records a captured packet against the trace it belongs to, if any.
+func (r *Recorder) handlePacket(packet gopacket.Packet) {
+	now := r.packetTime(packet)
 
-							if trace.Recorded >= traas2.TraceMaxReplies {
-								// trace fully recorded
-								continue
-							}
-							if r.debug {
-								log.Printf("Recorded expiry from %s at ttl %d.\n", ipFrame.SrcIP.String(), v4.Id)
-								trace.Hops[trace.Recorded].Packet = packet
+	//TODO: v6
+	ipFrame, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+	//icmp
+	if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
+		if packet.Layer(layers.LayerTypeICMPv4) != nil {
+			icmpframe := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			icmpType := icmpframe.TypeCode.Type()
+			if icmpType == layers.ICMPv4TypeTimeExceeded || icmpType == layers.ICMPv4TypeDestinationUnreachable {
+				original := gopacket.NewPacket(icmpframe.Payload, layers.LayerTypeIPv4, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+				// replies may quote too little of the probe to decode.
+				v4, ok := original.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				if ok {
+					if trace := r.active(v4.DstIP); trace != nil {
+						//fmt.Printf("Matched icmp to handler.\n")
+
+						// see if we got anything interesting in packet options
+						for _, opt := range v4.Options {
+							if opt.OptionType == 7 {
+								log.Printf("route recording got us %x", opt.OptionData)
+							} else if opt.OptionType == 4 {
+								log.Printf("timestamp got us %x", opt.OptionData)
 							}
-							trace.Hops[trace.Recorded].IP = ipFrame.SrcIP
-							trace.Hops[trace.Recorded].TTL = uint8(v4.Id)
-							trace.Hops[trace.Recorded].Received = time.Now()
-							trace.Hops[trace.Recorded].Latency = time.Now().Sub(trace.Hops[trace.Recorded].Sent) / 2
-							trace.Recorded++
+						}
+
+						hop := traas2.Hop{
+							IP:       ipFrame.SrcIP,
+							TTL:      uint8(v4.Id),
+							Received: now,
+							ICMPType: icmpType,
+							ICMPCode: icmpframe.TypeCode.Code(),
+							ReplyTTL: ipFrame.TTL,
+							// the RFC 4884 length is the second byte of the otherwise unused header field.
+							Extensions: traas2.ParseICMPExtensions(icmpframe.Payload, uint8(icmpframe.Id)),
+						}
+						if r.debug {
+							log.Printf("Recorded expiry from %s at ttl %d.\n", ipFrame.SrcIP.String(), v4.Id)
+							hop.Packet = packet
+						}
+						if hop, ok := trace.addHop(hop); ok {
+							r.publish(trace, traas2.EventHopReceived, &hop)
 						}
 					}
-				} else {
-					log.Printf("ICMP code %d.%d received from %s.", icmpframe.TypeCode.Type(), icmpframe.TypeCode.Code(), ipFrame.SrcIP)
 				}
+			} else {
+				log.Printf("ICMP code %d.%d received from %s.", icmpframe.TypeCode.Type(), icmpframe.TypeCode.Code(), ipFrame.SrcIP)
 			}
-			continue
-		}
-		//tcp
-		//fmt.Printf("Saw ip packet from %v\n", ipFrame.SrcIP.String())
-		if handler, ok := r.handlers.Get(ipFrame.SrcIP.String()); ok {
-			trace := handler.(*traas2.Trace)
-			if trace.Sent.IsZero() {
-				// Make sure this is the request for GET /<path/probe
-				tcpFrame := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
-				if tcpFrame == nil {
-					continue
-				}
-				payload := tcpFrame.Payload
-				if bytes.IndexByte(payload, 0x0D) == -1 {
-					continue
-				}
-				if !bytes.HasPrefix(payload, []byte("GET ")) ||
-					!bytes.Contains(payload[0:bytes.IndexByte(payload, 0x0D)], []byte(r.path+"/probe")) {
-					continue
-				}
+		}
+		return
+	}
+	//tcp
+	//fmt.Printf("Saw ip packet from %v\n", ipFrame.SrcIP.String())
+	if r.offline {
+		r.recordSent(packet, ipFrame, now)
+	}
+	if trace := r.active(ipFrame.SrcIP); trace != nil {
+		tcpFrame := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if tcpFrame == nil {
+			return
+		}
+		probe := trace.probe(r.probe)
+		if trace.triggered() {
+			// The server itself writes the payload of probes with their own trigger, like
+			// the websocket probe, so only acknowledgement of HTTP probes shows that one arrived.
+			if probe.Trigger != nil || !tcpFrame.ACK {
+				return
+			}
+			if ttl, ok := trace.reach(tcpFrame.Ack); ok {
+				sent := trace.sentAt(ttl)
+				r.publish(trace, traas2.EventDestinationReached, &traas2.Hop{
+					TTL:      ttl,
+					IP:       ipFrame.SrcIP,
+					Sent:     sent,
+					Received: now,
+					Latency:  now.Sub(sent) / 2,
+				})
+			}
+			return
+		}
+		if probe.Trigger != nil {
+			if !probe.Trigger(tcpFrame.Payload) {
+				return
+			}
+		} else if !r.isProbeRequest(uint16(tcpFrame.DstPort), tcpFrame.Payload) {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if !trace.trigger(tcpFrame.Ack, ipFrame.DstIP, now, cancel) {
+			cancel()
+			return
+		}
+		if !r.transition(trace, traas2.StateTriggered) {
+			cancel()
+			return
+		}
+		if r.offline {
+			// a replayed capture already holds the probes that were sent.
+			r.transition(trace, traas2.StateProbing)
+			return
+		}
+		r.probing.Add(2)
+		go r.sendProbes(ctx, probe, packet, trace)
+		go r.expireHops(ctx, trace)
+	}
+}
+
+// sendProbes probes a trace in reply to a packet. Replies are collected once
+// all probes are sent, or probing is cancelled, until the trace ends.
+func (r *Recorder) sendProbes(ctx context.Context, probe *traas2.Probe, packet gopacket.Packet, trace *activeTrace) {
+	defer r.probing.Done()
+	if !r.transition(trace, traas2.StateProbing) {
+		return
+	}
+	SpoofProbe(ctx, r.conn.ReplyWriter(packet), r.clock, probe, packet, trace.setSent, true)
+	r.transition(trace, traas2.StateCollecting)
+}
+
+// isProbeRequest checks that a payload, to port, is the request for GET /<path>/probe of a listener on that port.
+func (r *Recorder) isProbeRequest(port uint16, payload []byte) bool {
+	if bytes.IndexByte(payload, 0x0D) == -1 {
+		return false
+	}
+	return listenerEndpoint(r.listeners, port, requestPath(payload)) == "/probe"
+}
 
-				ctx, cancel := context.WithCancel(context.Background())
-				go SpoofProbe(ctx, r.probe, packet, trace, true)
+// packetTime is when a packet was seen: when it was captured if replaying a capture, or else now.
+func (r *Recorder) packetTime(packet gopacket.Packet) time.Time {
+	if r.offline && !packet.Metadata().Timestamp.IsZero() {
+		return packet.Metadata().Timestamp
+	}
+	return r.clock.Now()
+}
 
-				trace.Cancel = cancel
-				trace.Sent = time.Now()
+// recordSent notes when probes were sent, from the probes in a replayed capture.
+// Probes are recognized by their sequence number, and an IP id matching their TTL.
+func (r *Recorder) recordSent(packet gopacket.Packet, ipFrame *layers.IPv4, now time.Time) {
+	trace := r.active(ipFrame.DstIP)
+	if trace == nil {
+		return
+	}
+	tcpFrame, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || ipFrame.Id != uint16(ipFrame.TTL) {
+		return
+	}
+	trace.recordSent(tcpFrame.Seq, ipFrame.TTL, now)
+}
+
+// expireHops publishes timeouts for probes that go unanswered for hopTimeout,
+// until probing is cancelled.
+func (r *Recorder) expireHops(ctx context.Context, trace *activeTrace) {
+	defer r.probing.Done()
+	reported := make([]bool, probedTTLs)
+	deadline := r.clock.Now().Add(probeDuration + 2*hopTimeout)
+	for {
+		var now time.Time
+		select {
+		case now = <-r.clock.After(probeInterval):
+		case <-ctx.Done():
+			return
+		}
+		if r.active(trace.to) != trace || now.After(deadline) {
+			return
+		}
+		pending := false
+		for i := range reported {
+			if reported[i] {
+				continue
 			}
+			ttl := uint8(i + traas2.TraceShortestTTL)
+			sent := trace.sentAt(ttl)
+			if sent.IsZero() || now.Sub(sent) < hopTimeout {
+				pending = true
+				continue
+			}
+			reported[i] = true
+			if !trace.answered(ttl) {
+				r.publish(trace, traas2.EventHopTimeout, &traas2.Hop{TTL: ttl, Sent: sent})
+			}
+		}
+		if !pending {
+			return
 		}
 	}
-	return nil
+}
+
+// publish notifies subscribers of an event on a trace. Events without a hop
+// carry a snapshot of the trace.
+func (r *Recorder) publish(trace *activeTrace, kind string, hop *traas2.Hop) {
+	ev := traas2.Event{Type: kind, ID: trace.id, Time: r.clock.Now(), Hop: hop}
+	if hop == nil {
+		ev.Trace = trace.snapshot()
+	}
+	r.events.publish(ev)
+}
+
+// Subscribe returns a channel of events for the trace with a given id, or all traces if id is empty.
+// The returned function releases the subscription.
+func (r *Recorder) Subscribe(id string) (<-chan traas2.Event, func()) {
+	return r.events.subscribe(id)
+}
+
+// newTraceID generates a random identifier for a trace.
+func newTraceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 // Managing traces
 
-// BeginTrace initializes a trace on a specific IP. Triggers sending of 302 probes and recording responses.
-func (r *Recorder) BeginTrace(to net.IP) *traas2.Trace {
-	t := new(traas2.Trace)
-	t.To = to
-	r.handlers.Set(to.String(), t)
-	return t
+// active returns the trace being recorded for a given IP, if any.
+func (r *Recorder) active(to net.IP) *activeTrace {
+	if val, ok := r.handlers.Get(to.String()); ok {
+		return val.(*activeTrace)
+	}
+	return nil
+}
+
+// BeginTrace initializes a trace on a specific IP. Triggers sending of probes and recording responses.
+// The trace is probed with probe, or the recorder's own if nil. An unfinished trace of the same IP is cancelled.
+// Like all traces returned by the recorder, the returned trace is a snapshot.
+func (r *Recorder) BeginTrace(to net.IP, probe *traas2.Probe) *traas2.Trace {
+	// the address the client connects to is only known for certain once it requests probes.
+	var from net.IP
+	if len(r.addrs) > 0 {
+		from = r.addrs[0]
+	}
+	return r.begin(to, from, probe, r.clock.Now()).snapshot()
+}
+
+// begin starts recording a trace from one IP to another, started at a given time.
+func (r *Recorder) begin(to, from net.IP, probe *traas2.Probe, started time.Time) *activeTrace {
+	t := &traas2.Trace{
+		ID:      newTraceID(),
+		From:    from,
+		To:      to,
+		Started: started,
+		Probe:   probe,
+	}
+	trace := newActiveTrace(t)
+	var replaced *activeTrace
+	r.handlers.Upsert(to.String(), trace, func(exists bool, old interface{}, new interface{}) interface{} {
+		if exists {
+			replaced = old.(*activeTrace)
+		}
+		return new
+	})
+	if replaced != nil {
+		r.finishTrace(replaced, traas2.StateCancelled)
+	}
+	r.publish(trace, traas2.EventTraceStart, nil)
+	r.transition(trace, traas2.StatePending)
+	return trace
 }
 
 // GetTrace returns the trace if present for a given IP
 func (r *Recorder) GetTrace(to net.IP) *traas2.Trace {
-	if val, ok := r.handlers.Get(to.String()); ok {
-		return val.(*traas2.Trace)
+	if trace := r.active(to); trace != nil {
+		return trace.snapshot()
 	}
 	return nil
 }
 
-// EndTrace cleans up after an active trace.
-func (r *Recorder) EndTrace(to net.IP) {
-	if val, ok := r.handlers.Get(to.String()); ok {
-		tr := val.(*traas2.Trace)
-		tr.Cancel()
+// FindTrace returns the active trace with a given id, if present.
+func (r *Recorder) FindTrace(id string) *traas2.Trace {
+	for item := range r.handlers.IterBuffered() {
+		if trace := item.Val.(*activeTrace); trace.id == id {
+			return trace.snapshot()
+		}
+	}
+	return nil
+}
+
+// EndTrace completes an active trace, and sorts its recorded hops into a route.
+// The ended trace is returned, or nil if there was no active trace.
+func (r *Recorder) EndTrace(to net.IP) *traas2.Trace {
+	trace := r.active(to)
+	if trace == nil {
+		return nil
+	}
+	return r.finishTrace(trace, traas2.StateComplete)
+}
+
+// ActiveTraces counts the traces being recorded.
+func (r *Recorder) ActiveTraces() int {
+	return r.handlers.Count()
+}
+
+// EndTraces completes every active trace, and returns them.
+func (r *Recorder) EndTraces() []*traas2.Trace {
+	var ended []*traas2.Trace
+	for item := range r.handlers.IterBuffered() {
+		if t := r.finishTrace(item.Val.(*activeTrace), traas2.StateComplete); t != nil {
+			ended = append(ended, t)
+		}
+	}
+	return ended
+}
+
+// Close stops recording. Active traces are cancelled, and Close waits for
+// their probes to stop before closing the capture.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		for item := range r.handlers.IterBuffered() {
+			r.finishTrace(item.Val.(*activeTrace), traas2.StateCancelled)
+		}
+		r.probing.Wait()
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		r.running.Wait()
+	})
+	return nil
+}
+
+// finishTrace ends a trace in a final state, stopping its probes and building its route.
+// The finished trace is returned, or nil if the trace had already finished.
+func (r *Recorder) finishTrace(trace *activeTrace, state traas2.State) *traas2.Trace {
+	if !r.transition(trace, state) {
+		return nil
 	}
-	r.handlers.Remove(to.String())
+	// Probing may not have started, so there may be nothing to cancel.
+	trace.cancel()
+	r.handlers.RemoveCb(trace.to.String(), func(key string, v interface{}, exists bool) bool {
+		return exists && v == trace
+	})
+	t := trace.buildRoute()
+	r.events.publish(traas2.Event{Type: traas2.EventTraceComplete, ID: t.ID, Time: r.clock.Now(), Trace: t})
+	return t
 }
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/willscott/traas2"
+)
+
+// pcapngMagic begins pcapng captures.
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// openCapture reads the packets of a pcap or pcapng file.
+func openCapture(file *os.File) (*gopacket.PacketSource, error) {
+	in := bufio.NewReader(file)
+	magic, err := in.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(in, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacketSource(ng, ng.LinkType()), nil
+	}
+	r, err := pcapgo.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return gopacket.NewPacketSource(r, r.LinkType()), nil
+}
+
+// captureClock is the time of a capture being replayed: when its last packet
+// was captured. Nothing waits while replaying, so waits end at once.
+type captureClock struct {
+	now time.Time
+}
+
+func (c *captureClock) Now() time.Time { return c.now }
+
+func (c *captureClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+// Replay rebuilds the traces in a pcap capture taken on a server with configuration conf.
+// A trace begins when a client requests a new trace, and ends when it requests
+// the result, or at the end of the capture. Times are those of the capture,
+// and no probes are sent: the probes in the capture give the times probes were sent.
+func Replay(conf Config, file string) ([]*traas2.Trace, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	source, err := openCapture(f)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := Listeners(conf)
+	r := newRecorder(nil, listeners, redirectProbe("./done", nil), conf.Debug)
+	r.offline = true
+	clock := &captureClock{}
+	r.clock = clock
+	traces := make([]*traas2.Trace, 0)
+	for packet := range source.Packets() {
+		clock.now = r.packetTime(packet)
+		ipFrame, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		tcpFrame, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if ipFrame != nil && tcpFrame != nil {
+			switch endpoint := listenerEndpoint(listeners, uint16(tcpFrame.DstPort), requestPath(tcpFrame.Payload)); endpoint {
+			case "/start", "/trace", "/ws":
+				if t := r.EndTrace(ipFrame.SrcIP); t != nil {
+					traces = append(traces, t)
+				}
+				var probe *traas2.Probe
+				if endpoint == "/ws" {
+					probe = wsProbe
+				}
+				r.begin(ipFrame.SrcIP, ipFrame.DstIP, probe, r.packetTime(packet))
+			case "/done":
+				if t := r.EndTrace(ipFrame.SrcIP); t != nil {
+					traces = append(traces, t)
+				}
+			}
+		}
+		r.handlePacket(packet)
+	}
+
+	traces = append(traces, r.EndTraces()...)
+	sort.SliceStable(traces, func(i, j int) bool {
+		return traces[i].Started.Before(traces[j].Started)
+	})
+	return traces, nil
+}
+
+// requestPath is the path requested by a payload beginning an HTTP GET request, or "" for other payloads.
+func requestPath(payload []byte) string {
+	if !bytes.HasPrefix(payload, []byte("GET ")) {
+		return ""
+	}
+	line := payload[4:]
+	if end := bytes.IndexByte(line, ' '); end != -1 {
+		line = line[:end]
+	}
+	u, err := url.ParseRequestURI(string(line))
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/willscott/traas2"
+)
+
+// captureWriter builds a pcap capture of a server's traffic for replay.
+type captureWriter struct {
+	t   *testing.T
+	w   *pcapgo.Writer
+	now time.Time
+}
+
+func (c *captureWriter) write(after time.Duration, ls ...gopacket.SerializableLayer) {
+	c.now = c.now.Add(after)
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		c.t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: c.now, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+	if err := c.w.WritePacket(ci, buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func ipv4(src, dst net.IP, proto layers.IPProtocol, id uint16, ttl uint8) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, Id: id, TTL: ttl, Protocol: proto, SrcIP: src, DstIP: dst}
+}
+
+func TestReplay(t *testing.T) {
+	server, client := net.IPv4(192, 0, 2, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	routers := []net.IP{net.IPv4(198, 51, 100, 1).To4(), net.IPv4(198, 51, 100, 2).To4()}
+	request := func(path string, seq, ack uint32) []gopacket.SerializableLayer {
+		return []gopacket.SerializableLayer{
+			ipv4(client, server, layers.IPProtocolTCP, 1, 64),
+			&layers.TCP{SrcPort: 5000, DstPort: 8080, Seq: seq, Ack: ack, ACK: true, PSH: true},
+			gopacket.Payload("GET " + path + " HTTP/1.1\r\nHost: x\r\n\r\n"),
+		}
+	}
+	probe := func(ttl uint8) []gopacket.SerializableLayer {
+		return []gopacket.SerializableLayer{
+			ipv4(server, client, layers.IPProtocolTCP, uint16(ttl), ttl),
+			&layers.TCP{SrcPort: 8080, DstPort: 5000, Seq: 500, Ack: 200, ACK: true, PSH: true},
+			gopacket.Payload("HTTP/1.1 302 Found\r\n\r\n"),
+		}
+	}
+	expired := func(router net.IP, ttl uint8) []gopacket.SerializableLayer {
+		// The quote is the probe's IP header, and the start of its TCP header.
+		quote := gopacket.NewSerializeBuffer()
+		gopacket.SerializeLayers(quote, gopacket.SerializeOptions{FixLengths: true},
+			ipv4(server, client, layers.IPProtocolTCP, uint16(ttl), 1), gopacket.Payload(make([]byte, 8)))
+		return []gopacket.SerializableLayer{
+			ipv4(router, server, layers.IPProtocolICMPv4, 0, 250),
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)},
+			gopacket.Payload(quote.Bytes()),
+		}
+	}
+
+	f, err := ioutil.TempFile("", "traas-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	start := time.Unix(1500000000, 0)
+	c := &captureWriter{t: t, w: pcapgo.NewWriter(f), now: start}
+	c.w.WriteFileHeader(2048, layers.LinkTypeEthernet)
+	c.write(0, request("/traas/start", 100, 400)...)
+	c.write(10*time.Millisecond, request("/traas/probe", 150, 500)...)
+	c.write(time.Millisecond, probe(4)...)
+	c.write(0, probe(5)...)
+	c.write(5*time.Millisecond, expired(routers[0], 4)...)
+	c.write(5*time.Millisecond, expired(routers[1], 5)...)
+	// the client acknowledges the probe that reached it.
+	c.write(time.Millisecond, ipv4(client, server, layers.IPProtocolTCP, 2, 64), &layers.TCP{SrcPort: 5000, DstPort: 8080, Seq: 200, Ack: 522, ACK: true})
+	c.write(time.Second, request("/traas/done", 300, 600)...)
+	f.Close()
+
+	traces, err := Replay(Config{Path: "/traas", ListenPort: 8080}, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 {
+		t.Fatalf("Expected one trace, got %d", len(traces))
+	}
+	tr := traces[0]
+	if !tr.Started.Equal(start) || !tr.To.Equal(client) || !tr.From.Equal(server) || !tr.Reached {
+		t.Fatalf("Unexpected trace %+v", tr)
+	}
+	// The trace ends when the capture shows it was requested.
+	if tr.State != traas2.StateComplete || !tr.Changed.Equal(c.now) {
+		t.Fatalf("Expected the trace to complete at %v, got %s at %v", c.now, tr.State, tr.Changed)
+	}
+	want := []traas2.Hop{
+		{TTL: 4, IP: routers[0], Latency: 2500 * time.Microsecond},
+		{TTL: 5, IP: routers[1], Latency: 5 * time.Millisecond},
+	}
+	if len(tr.Route) != len(want) {
+		t.Fatalf("Expected %d hops, got %+v", len(want), tr.Route)
+	}
+	for i, hop := range want {
+		got := tr.Route[i]
+		if got.TTL != hop.TTL || !got.IP.Equal(hop.IP) || got.Latency != hop.Latency || got.ReplyTTL != 250 {
+			t.Fatalf("Expected hop %+v, got %+v", hop, got)
+		}
+	}
+}
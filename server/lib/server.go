@@ -1,12 +1,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,23 +19,96 @@ import (
 type Server struct {
 	sync.Mutex
 	webServer http.Server
-	recorder  *Recorder
+	mux       *http.ServeMux
+	recorder  TraceRecorder
+	store     Store
+	sinks     *Sinks
 	probe     *traas2.Probe
 	config    Config
+	clock     Clock
+	// probeTimeout is how long a client waits for probes before the trace
+	// fails: as long as the trace may be triggered and probing.
+	probeTimeout time.Duration
+	// formatProbes redirect clients to the result of their trace in a given format.
+	formatProbes map[string]*traas2.Probe
+	// listeners serve traas at their paths, sharing the server's recorder and
+	// store. Each is a Server of its own, whose parent is the server.
+	listeners []*Server
+	parent    *Server
+	// stopping is closed when the server shuts down, cancelling requests.
+	// Traces begin holding starting, so none begin once it is closed.
+	stopping  chan struct{}
+	starting  sync.RWMutex
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // Config stores longterm state of how the server behaves
 type Config struct {
-	ServePort  uint16      // What port for webServer
-	ListenPort uint16      // What port for pcap
-	Path       string      // What web path does traas live at
-	Root       string      // where is the go code (and static files) for traas
-	Device     string      // What network interface is listened to
-	Dst        string      // Ethernet address of the gateway network interface
-	IPHeader   string      // If client ips should be checked from e.g. an x-forwarded-for header
-	TraceFile  string      // file to log traces.
-	Debug      bool        // If diagnostic debugging should be enabled
-	TraceLog   *log.Logger `json:"-"`
+	ServePort     uint16           // What port for webServer
+	ListenPort    uint16           // What port for pcap
+	Path          string           // What web path does traas live at
+	Root          string           // Folder with a demo/ folder of files that replace those of the embedded demo
+	Device        string           // What network interface is listened to
+	Dst           string           // Ethernet address of the gateway network interface
+	Devices       []DeviceConfig   // Network interfaces listened to. If unset, there is one of Device and Dst.
+	IPHeader      string           // If client ips should be checked from e.g. an x-forwarded-for header
+	TraceFile     string           // file to log traces.
+	TraceMaxSize  int              // Megabytes the trace file may grow to before it is rotated
+	TraceMaxAge   int              // Seconds the trace file is written before it is rotated
+	TraceCompress bool             // If rotated trace files should be gzipped
+	ServerID      string           // Identity of this server in trace logs
+	Debug         bool             // If diagnostic debugging should be enabled
+	StoreSize     int              // How many completed traces are kept for retrieval in memory
+	StoreTTL      int              // How many seconds completed traces are kept for retrieval
+	Database      string           // File of an on-disk trace database. Traces are kept in memory if unset.
+	APIToken      string           // Bearer token required to list stored traces. Listing is disabled if unset.
+	Sinks         []SinkConfig     // Additional destinations for completed traces
+	Timeouts      map[string]int   // Seconds a trace may stay in a state, by state name, before it expires
+	MaxTraces     int              // How many traces may run at once, across all listeners. Unlimited if unset.
+	Listeners     []ListenerConfig // Frontends traas is served through. If unset, there is one of ListenPort, Path and MaxTraces.
+	TraceLog      *TraceLog        `json:"-"`
+}
+
+// collectDelay is how long replies are waited for once probing has stopped.
+const collectDelay = 500 * time.Millisecond
+
+// hopTimeout is how long a probe may go unanswered before it is reported as timed out.
+const hopTimeout = collectDelay
+
+// eventWait is how long an event stream waits for a trace to start for the requesting client.
+const eventWait = 5 * time.Second
+
+// maxImportSize is the longest warts file accepted by an import.
+const maxImportSize = 64 << 20
+
+// wsProbe is injected into websocket traces. An unsolicited pong is ignored
+// by the client, and is the first message the server writes after the
+// client starts the trace, so the stream is the same whichever copy arrives.
+var wsProbe = &traas2.Probe{
+	Payload: wsFrame(wsOpPong, nil),
+	Trigger: isWSClientFrame,
+}
+
+// redirectProbe is injected into HTTP traces, redirecting the client to location.
+// Any headers are added to the response.
+func redirectProbe(location string, headers map[string]string) *traas2.Probe {
+	redirect := "HTTP/1.1 302 Found\r\n" +
+		"Location: " + location + "\r\n" +
+		probeHeaders(headers) +
+		"Connection: Close\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	return &traas2.Probe{
+		Payload: []byte(redirect),
+	}
+}
+
+// wsMessage is the envelope of messages streamed over websocket traces.
+type wsMessage struct {
+	Type  string        `json:"type"`
+	Hop   *traas2.Hop   `json:"hop,omitempty"`
+	Trace *traas2.Trace `json:"trace,omitempty"`
 }
 
 func getIP(header string, r *http.Request) net.IP {
@@ -51,18 +126,114 @@ func getIP(header string, r *http.Request) net.IP {
 	return ip
 }
 
-// StartHandler triggers the start of traces.
+// endTrace finishes the active trace for ip, keeps it for later retrieval and sends it to sinks.
+func (s *Server) endTrace(ip net.IP) *traas2.Trace {
+	t := s.recorder.EndTrace(ip)
+	if t != nil {
+		s.saveTrace(t)
+	}
+	return t
+}
+
+// saveTrace stores a completed trace, and delivers it to sinks, including those of the parent server.
+func (s *Server) saveTrace(t *traas2.Trace) {
+	if err := s.store.Put(t); err != nil {
+		log.Printf("Failed to store trace %s: %v\n", t.ID, err)
+	}
+	s.sinks.Write(t)
+	if s.parent != nil {
+		s.parent.sinks.Write(t)
+	}
+}
+
+// saveExpired saves a trace that expired through the listener it was begun
+// through, or as the server's own if that listener no longer tracks it.
+func (s *Server) saveExpired(t *traas2.Trace) {
+	for _, l := range s.listeners {
+		if lr, ok := l.recorder.(*listenerRecorder); ok && lr.owns(t) {
+			lr.forget(t.To.String(), t.ID)
+			l.saveTrace(t)
+			return
+		}
+	}
+	s.saveTrace(t)
+}
+
+// Reopen reopens file backed trace sinks, for use after they are moved by an external tool.
+func (s *Server) Reopen() {
+	s.sinks.Reopen()
+	for _, l := range s.listeners {
+		l.sinks.Reopen()
+	}
+}
+
+// StartHandler triggers the start of traces. The trace is returned in the
+// format named by the `format` query parameter, if set.
 func (s *Server) StartHandler(w http.ResponseWriter, r *http.Request) {
+	s.startTrace(w, r, r.URL.Query().Get("format"))
+}
+
+// OneShotHandler runs a whole trace for clients that follow redirects, like `curl -L`,
+// ending with the trace as a traceroute-style text table.
+func (s *Server) OneShotHandler(w http.ResponseWriter, r *http.Request) {
+	s.startTrace(w, r, formatText)
+}
+
+// startTrace begins a trace for the client and redirects it to be probed.
+// The probe redirects the client to the result in format, or in the
+// negotiated format if no format is given.
+func (s *Server) startTrace(w http.ResponseWriter, r *http.Request, format string) {
 	ip := getIP(s.config.IPHeader, r)
 	if ip == nil {
-		http.Redirect(w, r, "/"+s.config.Path+"/error", 302)
+		http.Redirect(w, r, s.config.Path+"/error", 302)
+		return
+	}
+	if !s.admit(w, ip) {
 		return
 	}
 	log.Printf("Beginning trace for %v\n", ip)
-	s.recorder.BeginTrace(ip)
+	probe, ok := s.formatProbes[format]
+	if !ok {
+		probe = s.probe
+	}
+	if s.beginTrace(ip, probe) == nil {
+		http.Error(w, "the server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	http.Redirect(w, r, s.config.Path+"/probe", 302)
 }
 
+// beginTrace begins a trace of the client, unless the server has stopped.
+func (s *Server) beginTrace(ip net.IP, probe *traas2.Probe) *traas2.Trace {
+	root := s
+	if s.parent != nil {
+		root = s.parent
+	}
+	root.starting.RLock()
+	defer root.starting.RUnlock()
+	select {
+	case <-root.stopping:
+		return nil
+	default:
+	}
+	return s.recorder.BeginTrace(ip, probe)
+}
+
+// admit checks that a client may start a trace, turning it away if the
+// server, or the server it is a listener of, is at its limit. A client
+// restarting its trace is always admitted.
+func (s *Server) admit(w http.ResponseWriter, ip net.IP) bool {
+	if s.parent != nil && !s.parent.admit(w, ip) {
+		return false
+	}
+	if s.config.MaxTraces > 0 && s.recorder.ActiveTraces() >= s.config.MaxTraces && s.recorder.GetTrace(ip) == nil {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many traces are running", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
 // EndHandler finishes traces
 func (s *Server) EndHandler(w http.ResponseWriter, r *http.Request) {
 	ip := getIP(s.config.IPHeader, r)
@@ -70,35 +241,288 @@ func (s *Server) EndHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, s.config.Path+"/error", 302)
 		return
 	}
-	closeNotifier, ok := w.(http.CloseNotifier)
-	if !ok {
+	if t := s.recorder.GetTrace(ip); t != nil {
+		if t.Cancel != nil {
+			t.Cancel()
+		}
+
+		// Wait an extra moment for the trace to get filled in.
+		select {
+		case <-s.clock.After(collectDelay):
+			if t := s.endTrace(ip); t != nil {
+				writeTraces(w, r, []*traas2.Trace{t}, true)
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// WebSocketHandler runs a full trace over a single websocket connection.
+// Once the client sends its first message, probes are injected on the
+// connection and each hop is streamed back as it is recorded, followed by
+// a summary of the full trace.
+func (s *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	ip := getIP(s.config.IPHeader, r)
+	if ip == nil {
 		http.Redirect(w, r, s.config.Path+"/error", 302)
+		return
+	}
+	if !s.admit(w, ip) {
+		return
+	}
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	defer conn.Close()
 
-	if t := s.recorder.GetTrace(ip); t != nil {
-		t.Cancel()
+	t := s.beginTrace(ip, wsProbe)
+	if t == nil {
+		return
+	}
+	events, unsubscribe := s.recorder.Subscribe(t.ID)
+	defer unsubscribe()
+	finished := false
+	defer func() {
+		if !finished {
+			s.endTrace(ip)
+		}
+	}()
+
+	if err := conn.Accept(); err != nil {
+		return
+	}
+	log.Printf("Beginning websocket trace for %v\n", ip)
+	if _, _, err := conn.ReadFrame(); err != nil {
+		return
+	}
+	// This must be the first write after the client's message, matching the probes.
+	if err := conn.WriteRaw(wsProbe.Payload); err != nil {
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, _, err := conn.ReadFrame()
+			if err != nil || op == wsOpClose {
+				return
+			}
+		}
+	}()
+
+	done := s.clock.After(probeDuration + collectDelay)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != traas2.EventHopReceived {
+				continue
+			}
+			b, err := json.Marshal(wsMessage{Type: "hop", Hop: ev.Hop})
+			if err != nil {
+				continue
+			}
+			if err := conn.WriteText(b); err != nil {
+				return
+			}
+		case <-done:
+			finished = true
+			if t := s.endTrace(ip); t != nil {
+				if b, err := json.Marshal(wsMessage{Type: "summary", Trace: t}); err == nil {
+					conn.WriteText(b)
+				}
+			}
+			return
+		case <-closed:
+			return
+		}
+	}
+}
 
-		// Wait an extra second for the trace to get filled in.
-		delayTime := time.Millisecond * 500
+// awaitTrace finds the id of the current trace for ip, waiting up to eventWait for one to begin.
+func (s *Server) awaitTrace(ctx context.Context, ip net.IP) string {
+	events, unsubscribe := s.recorder.Subscribe("")
+	defer unsubscribe()
+	if t := s.recorder.GetTrace(ip); t != nil {
+		return t.ID
+	}
+	timeout := s.clock.After(eventWait)
+	for {
 		select {
-		case <-time.After(delayTime):
-			s.recorder.EndTrace(ip)
-			//sort and create route from recorded hops.
-			hops := make(traas2.Route, t.Recorded)
-			for i := uint16(0); i < t.Recorded; i++ {
-				hops[i] = t.Hops[i]
+		case ev := <-events:
+			if ev.Type == traas2.EventTraceStart && ev.Trace.To.Equal(ip) {
+				return ev.ID
 			}
-			sort.Sort(hops)
-			t.Route = hops
+		case <-timeout:
+			return ""
+		case <-ctx.Done():
+			return ""
+		}
+	}
+}
+
+// EventsHandler streams the progress of a trace as server-sent events.
+// A trace is selected by id as <path>/events/<id>, or without an id the next
+// or current trace of the requesting client is followed.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Path+"/events"), "/")
+
+	if id == "" {
+		ip := getIP(s.config.IPHeader, r)
+		if ip == nil {
+			http.Error(w, "unknown client", http.StatusBadRequest)
+			return
+		}
+		if id = s.awaitTrace(r.Context(), ip); id == "" {
+			http.Error(w, "no trace started", http.StatusNotFound)
+			return
+		}
+	}
+	events, unsubscribe := s.recorder.Subscribe(id)
+	if s.recorder.FindTrace(id) == nil {
+		unsubscribe()
+		http.NotFound(w, r)
+		return
+	}
+	defer unsubscribe()
 
-			if b, err := json.Marshal(t); err == nil {
-				w.Write(b)
-				s.config.TraceLog.Println(string(b))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: 10000\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
 			}
-		case <-closeNotifier.CloseNotify():
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+			flusher.Flush()
+			if ev.Type == traas2.EventTraceComplete {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// TraceHandler returns a completed trace by id, as <path>/trace/<id>.
+func (s *Server) TraceHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, s.config.Path+"/trace/")
+	t, err := s.store.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeTraces(w, r, []*traas2.Trace{t}, true)
+}
+
+// TracesHandler lists completed traces. Results can be filtered with the
+// `ip` or `prefix` of the client, a `hop` IP on the route, a `since` / `until`
+// range of RFC 3339 times, and a maximum count with `limit`.
+func (s *Server) TracesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.config.APIToken == "" || r.Header.Get("Authorization") != "Bearer "+s.config.APIToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.importTraces(w, r)
+		return
+	}
+	filter, err := parseTraceFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	traces, err := s.store.List(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTraces(w, r, traces, false)
+}
+
+// importTraces stores the traceroutes of a posted warts file, and responds with their new IDs.
+func (s *Server) importTraces(w http.ResponseWriter, r *http.Request) {
+	traces, err := traas2.ReadWarts(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := make([]string, 0, len(traces))
+	for _, t := range traces {
+		t.ID = newTraceID()
+		if err := s.store.Put(t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		ids = append(ids, t.ID)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, ids)
+}
+
+// parseTraceFilter reads a TraceFilter from request query parameters.
+func parseTraceFilter(r *http.Request) (TraceFilter, error) {
+	q := r.URL.Query()
+	return ParseTraceFilter(q.Get("ip"), q.Get("prefix"), q.Get("hop"), q.Get("since"), q.Get("until"), q.Get("limit"))
+}
+
+// ParseTraceFilter builds a TraceFilter from its textual parameters. Empty parameters are ignored.
+func ParseTraceFilter(ip, prefix, hop, since, until, limit string) (TraceFilter, error) {
+	var filter TraceFilter
+	var err error
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return filter, fmt.Errorf("invalid ip %q", ip)
+		}
+		bits := 8 * net.IPv6len
+		if parsed.To4() != nil {
+			parsed = parsed.To4()
+			bits = 8 * net.IPv4len
+		}
+		filter.Prefix = &net.IPNet{IP: parsed, Mask: net.CIDRMask(bits, bits)}
+	} else if prefix != "" {
+		if _, filter.Prefix, err = net.ParseCIDR(prefix); err != nil {
+			return filter, err
+		}
+	}
+	if hop != "" {
+		if filter.HopIP = net.ParseIP(hop); filter.HopIP == nil {
+			return filter, fmt.Errorf("invalid hop %q", hop)
+		}
+	}
+	if since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+	if until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+	if limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
 }
 
 // ProbeHandler waits for probes to be received, then prints state.
@@ -109,15 +533,11 @@ func (s *Server) ProbeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	closeNotifier, ok := w.(http.CloseNotifier)
-	if !ok {
-		http.Redirect(w, r, s.config.Path+"/error", 302)
-	}
 	select {
-	case <-time.After(time.Second * 10):
-		s.recorder.EndTrace(ip)
+	case <-s.clock.After(s.probeTimeout):
+		s.endTrace(ip)
 		http.Redirect(w, r, s.config.Path+"/error", 302)
-	case <-closeNotifier.CloseNotify():
+	case <-r.Context().Done():
 		return
 	}
 }
@@ -127,40 +547,124 @@ func (s *Server) ErrorHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("\"Error.\""))
 }
 
-// NewServer creates an HTTP server with a given config.
+// NewServer creates an HTTP server with a given config, recording traces from the configured device.
 func NewServer(conf Config) *Server {
-	redirect := "HTTP/1.1 302 Found\r\n" +
-		"Location: ./done\r\n" +
-		"Connection: Close\r\n" +
-		"Content-Length: 0\r\n\r\n"
-	probe := &traas2.Probe{
-		Payload: []byte(redirect),
+	conn, err := OpenPcap(Devices(conf))
+	if err != nil {
+		log.Printf("Could not record packets: %v\n", err)
+		return nil
 	}
-	recorder, err := MakeRecorder(conf.Device, conf.Path, conf.ListenPort, probe, conf.Debug)
+	s, err := New(WithConfig(conf), WithPacketConn(conn, conf.ListenPort))
 	if err != nil {
+		conn.Close()
+		log.Printf("Could not create server: %v\n", err)
 		return nil
 	}
-	server := &Server{
-		config:   conf,
-		probe:    probe,
-		recorder: recorder,
+	return s
+}
+
+// NewServerWithRecorder creates an HTTP server with a given config, whose traces are recorded by recorder.
+func NewServerWithRecorder(conf Config, recorder TraceRecorder) *Server {
+	s, err := New(WithConfig(conf), WithRecorder(recorder))
+	if err != nil {
+		log.Printf("Could not create server: %v\n", err)
+		return nil
 	}
+	return s
+}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", conf.ServePort)
+// routes creates the mux of the server's endpoints.
+func (s *Server) routes() *http.ServeMux {
+	path := s.config.Path
 	mux := http.NewServeMux()
-	mux.HandleFunc(conf.Path+"/start", server.StartHandler)
-	mux.HandleFunc(conf.Path+"/probe", server.ProbeHandler)
-	mux.HandleFunc(conf.Path+"/done", server.EndHandler)
-	mux.HandleFunc(conf.Path+"/error", server.ErrorHandler)
+	mux.HandleFunc(path+"/start", s.StartHandler)
+	mux.HandleFunc(path+"/trace", s.OneShotHandler)
+	mux.HandleFunc(path+"/view", s.ViewHandler)
+	mux.HandleFunc(path+"/probe", s.ProbeHandler)
+	mux.HandleFunc(path+"/done", s.EndHandler)
+	mux.HandleFunc(path+"/error", s.ErrorHandler)
+	mux.HandleFunc(path+"/ws", s.WebSocketHandler)
+	mux.HandleFunc(path+"/events", s.EventsHandler)
+	mux.HandleFunc(path+"/events/", s.EventsHandler)
+	mux.HandleFunc(path+"/trace/", s.TraceHandler)
+	mux.HandleFunc(path+"/traces", s.TracesHandler)
 	// By default serve a demo site.
-	mux.Handle(conf.Path+"/client/", http.StripPrefix(conf.Path+"/client/", http.FileServer(http.Dir(conf.Root+"/demo"))))
-
-	server.webServer = http.Server{Addr: addr, Handler: mux}
+	mux.Handle(path+"/client/", http.StripPrefix(path+"/client/", demoHandler(s.config)))
+	return mux
+}
 
-	return server
+// ServeHTTP serves the traas endpoints below the path of each listener.
+// Requests are cancelled once the server is shutting down.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
 }
 
-// Serve begins listening for web connections on the port specified in config
+// Serve begins listening for web connections on the port specified in config.
+// Once the server is shut down, http.ErrServerClosed is returned.
 func (s *Server) Serve() error {
 	return s.webServer.ListenAndServe()
 }
+
+// Shutdown stops the server gracefully. Requests in flight are cancelled and
+// no more traces begin, then traces still running are ended, stored and
+// delivered to sinks. It then stops accepting connections, and waits for
+// requests to finish until ctx is done, before the recorder, sinks and store
+// are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	err := s.webServer.Shutdown(ctx)
+	if cerr := s.teardown(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close stops the server immediately, closing its connections, then saves
+// running traces and closes as Shutdown does.
+func (s *Server) Close() error {
+	err := s.webServer.Close()
+	if cerr := s.teardown(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// stop cancels requests in flight, and saves the traces still running.
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		s.starting.Lock()
+		close(s.stopping)
+		s.starting.Unlock()
+		for _, l := range s.listeners {
+			for _, t := range l.recorder.EndTraces() {
+				l.saveTrace(t)
+			}
+		}
+	})
+}
+
+// teardown stops the server, and closes the recorder, sinks and store.
+func (s *Server) teardown() error {
+	s.stop()
+	s.closeOnce.Do(func() {
+		closers := []interface{ Close() error }{s.recorder}
+		for _, l := range s.listeners {
+			closers = append(closers, l.sinks)
+		}
+		for _, c := range append(closers, s.sinks, s.store) {
+			if err := c.Close(); err != nil && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
+	})
+	return s.closeErr
+}
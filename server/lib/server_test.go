@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// fakeRecorder keeps traces without capturing packets.
+type fakeRecorder struct {
+	sync.Mutex
+	traces map[string]*traas2.Trace
+	events *eventBus
+	closed bool
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{traces: make(map[string]*traas2.Trace), events: newEventBus()}
+}
+
+func (f *fakeRecorder) BeginTrace(to net.IP, probe *traas2.Probe) *traas2.Trace {
+	f.Lock()
+	defer f.Unlock()
+	t := &traas2.Trace{ID: newTraceID(), To: to, Started: time.Now(), Probe: probe}
+	f.traces[to.String()] = t
+	f.events.publish(traas2.Event{Type: traas2.EventTraceStart, ID: t.ID, Trace: t})
+	return t
+}
+
+func (f *fakeRecorder) GetTrace(to net.IP) *traas2.Trace {
+	f.Lock()
+	defer f.Unlock()
+	return f.traces[to.String()]
+}
+
+func (f *fakeRecorder) FindTrace(id string) *traas2.Trace {
+	f.Lock()
+	defer f.Unlock()
+	for _, t := range f.traces {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (f *fakeRecorder) EndTrace(to net.IP) *traas2.Trace {
+	f.Lock()
+	defer f.Unlock()
+	t := f.traces[to.String()]
+	if t != nil {
+		delete(f.traces, to.String())
+		f.events.publish(traas2.Event{Type: traas2.EventTraceComplete, ID: t.ID, Trace: t})
+	}
+	return t
+}
+
+func (f *fakeRecorder) Subscribe(id string) (<-chan traas2.Event, func()) {
+	return f.events.subscribe(id)
+}
+
+func (f *fakeRecorder) EndTraces() []*traas2.Trace {
+	f.Lock()
+	var active []net.IP
+	for _, t := range f.traces {
+		active = append(active, t.To)
+	}
+	f.Unlock()
+	var ended []*traas2.Trace
+	for _, ip := range active {
+		ended = append(ended, f.EndTrace(ip))
+	}
+	return ended
+}
+
+func (f *fakeRecorder) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeRecorder) ActiveTraces() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.traces)
+}
+
+var testClient = net.ParseIP("10.0.0.1")
+
+func newTestServer(t *testing.T) (*Server, *fakeRecorder, *fakeClock) {
+	rec := newFakeRecorder()
+	clock := newFakeClock()
+	s, err := New(WithConfig(Config{Path: "/traas", StoreSize: 10, StoreTTL: 60}), WithRecorder(rec), WithClock(clock))
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	return s, rec, clock
+}
+
+// serve runs a request from the test client through the server, with a context that can be cancelled.
+func serve(s *Server, ctx context.Context, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+	req.RemoteAddr = testClient.String() + ":40000"
+	w := httptest.NewRecorder()
+	s.webServer.Handler.ServeHTTP(w, req)
+	return w
+}
+
+// serveAfter runs a request that waits on the server's clock, advancing the clock by d once it waits.
+func serveAfter(s *Server, clock *fakeClock, d time.Duration, path string) *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(s, context.Background(), path)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(d)
+	return <-done
+}
+
+func TestStartHandler(t *testing.T) {
+	s, rec, _ := newTestServer(t)
+	w := serve(s, context.Background(), "/traas/start?format=text")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/traas/probe" {
+		t.Fatalf("Expected a redirect to probe, got %d %v", w.Code, w.Header())
+	}
+	tr := rec.GetTrace(testClient)
+	if tr == nil || tr.Probe != s.listeners[0].formatProbes[formatText] {
+		t.Fatalf("Expected a text trace to begin, got %+v", tr)
+	}
+}
+
+func TestOneShotHandler(t *testing.T) {
+	s, rec, clock := newTestServer(t)
+	w := serve(s, context.Background(), "/traas/trace")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/traas/probe" {
+		t.Fatalf("Expected a redirect to probe, got %d %v", w.Code, w.Header())
+	}
+	tr := rec.GetTrace(testClient)
+	if tr == nil || !strings.Contains(string(tr.Probe.Payload), "Location: ./done?format=text\r\n") {
+		t.Fatalf("Expected a trace redirecting to its text result, got %+v", tr)
+	}
+
+	// Following the injected redirect returns the trace as a table.
+	w = serveAfter(s, clock, collectDelay, "/traas/done?format=text")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != formatTypes[formatText] {
+		t.Fatalf("Expected the trace as text, got %d %v", w.Code, w.Header())
+	}
+	if !strings.HasPrefix(w.Body.String(), "traceroute to 10.0.0.1 (trace "+tr.ID+")") {
+		t.Fatalf("Expected a traceroute table, got %q", w.Body)
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	s, rec, clock := newTestServer(t)
+
+	// Probes that never arrive end the trace with an error.
+	tr := s.listeners[0].recorder.BeginTrace(testClient, nil)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(s, context.Background(), "/traas/probe")
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(s.probeTimeout - time.Millisecond)
+	if rec.GetTrace(testClient) != tr {
+		t.Fatal("Expected the trace to continue until the probe timeout")
+	}
+	clock.Advance(time.Millisecond)
+	w := <-done
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/traas/error" {
+		t.Fatalf("Expected a redirect to error, got %d %v", w.Code, w.Header())
+	}
+	if rec.GetTrace(testClient) != nil {
+		t.Fatal("Expected the trace to end")
+	}
+	if stored, _ := s.store.Get(tr.ID); stored != tr {
+		t.Fatal("Expected the failed trace to be stored")
+	}
+
+	// A client that disconnects leaves its trace to be finished.
+	tr = s.listeners[0].recorder.BeginTrace(testClient, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := serve(s, ctx, "/traas/probe"); w.Body.Len() != 0 || rec.GetTrace(testClient) != tr {
+		t.Fatalf("Expected nothing to happen on disconnect, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestEndHandler(t *testing.T) {
+	s, rec, clock := newTestServer(t)
+
+	// The trace was never probed, so has nothing to cancel.
+	tr := s.listeners[0].recorder.BeginTrace(testClient, nil)
+	w := serveAfter(s, clock, collectDelay, "/traas/done")
+	var got traas2.Trace
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.ID != tr.ID {
+		t.Fatalf("Expected the trace, got %q: %v", w.Body, err)
+	}
+	if rec.GetTrace(testClient) != nil {
+		t.Fatal("Expected the trace to end")
+	}
+	if w := serve(s, context.Background(), "/traas/trace/"+tr.ID); w.Code != http.StatusOK {
+		t.Fatalf("Expected the trace to be stored, got %d", w.Code)
+	}
+
+	if w := serve(s, context.Background(), "/traas/done"); w.Body.Len() != 0 {
+		t.Fatalf("Expected no trace, got %q", w.Body)
+	}
+
+	// A client that disconnects leaves its trace to be finished.
+	tr = s.listeners[0].recorder.BeginTrace(testClient, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := serve(s, ctx, "/traas/done"); w.Body.Len() != 0 || rec.GetTrace(testClient) != tr {
+		t.Fatalf("Expected nothing to happen on disconnect, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	s, rec, _ := newTestServer(t)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	tr := s.listeners[0].recorder.BeginTrace(testClient, nil)
+
+	if resp, err := http.Get(ts.URL + "/traas/events/unknown"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected unknown traces not to be found, got %v: %v", resp, err)
+	}
+	resp, err := http.Get(ts.URL + "/traas/events/" + tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+	if line, err := stream.ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("Expected a retry interval, got %q: %v", line, err)
+	}
+
+	// The stream ends with the trace.
+	rec.EndTrace(testClient)
+	rest, err := ioutil.ReadAll(stream)
+	if err != nil || !strings.Contains(string(rest), "event: "+traas2.EventTraceComplete+"\ndata: ") {
+		t.Fatalf("Expected the trace to complete, got %q: %v", rest, err)
+	}
+}
+
+func TestTracesHandler(t *testing.T) {
+	s, err := New(WithConfig(Config{Path: "/traas", APIToken: "secret"}), WithRecorder(newFakeRecorder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	for i, ip := range []string{"10.0.0.1", "10.0.1.1", "192.168.0.1"} {
+		s.store.Put(&traas2.Trace{ID: ip, To: net.ParseIP(ip), Started: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	list := func(token, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/traas/traces"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	for _, token := range []string{"", "wrong"} {
+		if w := list(token, ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected listing with token %q to be refused, got %d", token, w.Code)
+		}
+	}
+	if w := list("secret", "?prefix=nonsense"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad filter to be rejected, got %d", w.Code)
+	}
+	for query, want := range map[string][]string{
+		"":                   {"192.168.0.1", "10.0.1.1", "10.0.0.1"},
+		"?prefix=10.0.0.0/8": {"10.0.1.1", "10.0.0.1"},
+		"?ip=10.0.0.1":       {"10.0.0.1"},
+		"?limit=1":           {"192.168.0.1"},
+	} {
+		w := list("secret", query)
+		var traces []*traas2.Trace
+		if err := json.Unmarshal(w.Body.Bytes(), &traces); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected a list of traces for %q, got %d %q", query, w.Code, w.Body)
+		}
+		ids := make([]string, len(traces))
+		for i, tr := range traces {
+			ids[i] = tr.ID
+		}
+		if strings.Join(ids, " ") != strings.Join(want, " ") {
+			t.Fatalf("Expected %v for %q, got %v", want, query, ids)
+		}
+	}
+}
+
+func TestImportTraces(t *testing.T) {
+	s, err := New(WithConfig(Config{Path: "/traas", APIToken: "secret", StoreTTL: 60}), WithRecorder(newFakeRecorder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Imported traces are kept for the ttl however long ago they were run.
+	old := &traas2.Trace{From: net.ParseIP("192.0.2.1"), To: net.ParseIP("10.0.0.1"), Started: time.Unix(1500000000, 0),
+		Route: traas2.Route{{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond}}}
+	var body bytes.Buffer
+	if err := traas2.WriteWarts(&body, []*traas2.Trace{old}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/traas/traces", &body)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var ids []string
+	if err := json.Unmarshal(w.Body.Bytes(), &ids); err != nil || w.Code != http.StatusOK || len(ids) != 1 {
+		t.Fatalf("Expected the id of the imported trace, got %d %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/traas/trace/"+ids[0], nil))
+	var tr traas2.Trace
+	if err := json.Unmarshal(w.Body.Bytes(), &tr); err != nil || w.Code != http.StatusOK || !tr.Started.Equal(old.Started) {
+		t.Fatalf("Expected the imported trace, got %d %q", w.Code, w.Body)
+	}
+
+	// Imports are limited in size, even of objects that are skipped.
+	object := make([]byte, 8+1<<20)
+	copy(object, []byte{0x12, 0x05, 0, 1, 0, 0x10, 0, 0})
+	body.Reset()
+	for body.Len() <= maxImportSize {
+		body.Write(object)
+	}
+	req = httptest.NewRequest("POST", "/traas/traces", &body)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too large") {
+		t.Fatalf("Expected an overlong import to be rejected, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestShutdownEvents(t *testing.T) {
+	rec := newFakeRecorder()
+	s := NewServerWithRecorder(Config{Path: "/traas", StoreSize: 10, StoreTTL: 60}, rec)
+	if s == nil {
+		t.Fatal("Could not create server")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.webServer.Serve(ln)
+	tr := s.listeners[0].recorder.BeginTrace(testClient, nil)
+
+	// An open event stream doesn't hold up shutting down.
+	resp, err := http.Get("http://" + ln.Addr().String() + "/traas/events/" + tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("Expected an event stream, got %q: %v", line, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the event stream to end on shutdown, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "traces.log")
+	rec := newFakeRecorder()
+	s := NewServerWithRecorder(Config{Path: "/traas", StoreSize: 10, StoreTTL: 60, Sinks: []SinkConfig{{Type: "file", Target: log}}}, rec)
+	if s == nil {
+		t.Fatal("Could not create server")
+	}
+	tr := s.listeners[0].recorder.BeginTrace(testClient, nil)
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.closed || rec.GetTrace(testClient) != nil {
+		t.Fatal("Expected the recorder to be closed, with its trace ended")
+	}
+	// The running trace was delivered to sinks before they closed.
+	b, err := ioutil.ReadFile(log)
+	if err != nil || !strings.Contains(string(b), tr.ID) {
+		t.Fatalf("Expected the running trace to be logged, got %q: %v", b, err)
+	}
+	// No trace begins once traces have been saved.
+	if w := serve(s, context.Background(), "/traas/start"); w.Code != http.StatusServiceUnavailable || rec.GetTrace(testClient) != nil {
+		t.Fatalf("Expected traces not to begin after shutdown, got %d", w.Code)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Expected closing again to do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// TraceSink receives completed traces.
+type TraceSink interface {
+	// Write delivers a completed trace.
+	Write(t *traas2.Trace) error
+	// Close releases resources held by the sink.
+	Close() error
+}
+
+// SinkConfig describes an additional destination for completed traces.
+type SinkConfig struct {
+	Type    string // One of "file", "syslog", "unix" or "webhook"
+	Target  string // File path, syslog tag, socket path or URL, by type
+	Prefix  string // Only traces to clients within this CIDR prefix, if set
+	Hop     string // Only traces with a hop at this IP, if set
+	Queue   int    // How many traces may wait for delivery before they are dropped. Default: 64
+	Retries int    // How many times failed webhook deliveries are retried
+}
+
+// defaultSinkQueue is the delivery queue length of sinks that don't configure one.
+const defaultSinkQueue = 64
+
+// webhookTimeout bounds a single webhook delivery attempt.
+const webhookTimeout = 10 * time.Second
+
+// socketWriteTimeout bounds a single write to a unix socket sink.
+const socketWriteTimeout = 10 * time.Second
+
+// webhookBackoff is the delay before the first webhook retry. Later retries double it.
+const webhookBackoff = time.Second
+
+// OpenSink creates the sink described by sc.
+func OpenSink(conf Config, sc SinkConfig) (TraceSink, error) {
+	switch sc.Type {
+	case "file":
+		fileConf := conf
+		fileConf.TraceFile = sc.Target
+		return OpenTraceLog(fileConf)
+	case "syslog":
+		return openSyslogSink(conf, sc.Target)
+	case "unix":
+		return &socketSink{path: sc.Target, conf: conf, timeout: socketWriteTimeout}, nil
+	case "webhook":
+		return &webhookSink{
+			url:     sc.Target,
+			retries: sc.Retries,
+			conf:    conf,
+			client:  &http.Client{Timeout: webhookTimeout},
+			done:    make(chan struct{}),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+// socketSink writes trace records as JSON lines to a unix domain socket,
+// reconnecting as needed.
+type socketSink struct {
+	path    string
+	conf    Config
+	timeout time.Duration // bounds each write
+	conn    net.Conn
+}
+
+func (s *socketSink) Write(t *traas2.Trace) error {
+	b, err := json.Marshal(NewTraceRecord(s.conf, t))
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if s.conn == nil {
+		if s.conn, err = net.Dial("unix", s.path); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err = s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *socketSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// webhookSink POSTs trace records to a URL, retrying failures with exponential backoff.
+type webhookSink struct {
+	url     string
+	retries int
+	conf    Config
+	client  *http.Client
+	done    chan struct{}
+	closing sync.Once
+}
+
+func (s *webhookSink) Write(t *traas2.Trace) error {
+	b, err := json.Marshal(NewTraceRecord(s.conf, t))
+	if err != nil {
+		return err
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		if err = s.post(b); err == nil || attempt >= s.retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (s *webhookSink) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// stop abandons retries, so that remaining traces are each posted once.
+func (s *webhookSink) stop() {
+	s.closing.Do(func() { close(s.done) })
+}
+
+func (s *webhookSink) Close() error {
+	s.stop()
+	return nil
+}
+
+// stopper is a sink that can give up retrying deliveries, so it can be closed promptly.
+type stopper interface {
+	stop()
+}
+
+// queuedSink isolates a sink behind a filter and its own delivery queue,
+// so that a slow or failing sink never blocks trace completion.
+type queuedSink struct {
+	name   string
+	sink   TraceSink
+	filter TraceFilter
+	queue  chan *traas2.Trace
+	done   chan struct{}
+}
+
+func newQueuedSink(name string, sink TraceSink, filter TraceFilter, size int) *queuedSink {
+	if size <= 0 {
+		size = defaultSinkQueue
+	}
+	q := &queuedSink{
+		name:   name,
+		sink:   sink,
+		filter: filter,
+		queue:  make(chan *traas2.Trace, size),
+		done:   make(chan struct{}),
+	}
+	go q.deliver()
+	return q
+}
+
+func (q *queuedSink) deliver() {
+	defer close(q.done)
+	for t := range q.queue {
+		if err := q.sink.Write(t); err != nil {
+			log.Printf("Trace sink %s failed to write trace %s: %v\n", q.name, t.ID, err)
+		}
+	}
+}
+
+// offer queues a trace for delivery if it matches the filter, dropping it if the queue is full.
+func (q *queuedSink) offer(t *traas2.Trace) {
+	if !q.filter.Match(t) {
+		return
+	}
+	select {
+	case q.queue <- t:
+	default:
+		log.Printf("Trace sink %s is behind, dropped trace %s\n", q.name, t.ID)
+	}
+}
+
+// close waits for queued traces to be delivered, without retries, then closes the sink.
+func (q *queuedSink) close() error {
+	close(q.queue)
+	if s, ok := q.sink.(stopper); ok {
+		s.stop()
+	}
+	<-q.done
+	return q.sink.Close()
+}
+
+// Sinks fans completed traces out to a set of trace sinks.
+type Sinks struct {
+	sync.Mutex
+	sinks []*queuedSink
+}
+
+// OpenSinks creates the configured sinks, along with conf.TraceLog if set.
+func OpenSinks(conf Config) (*Sinks, error) {
+	s := &Sinks{}
+	if conf.TraceLog != nil {
+		s.sinks = append(s.sinks, newQueuedSink("log", conf.TraceLog, TraceFilter{}, 0))
+	}
+	for _, sc := range conf.Sinks {
+		filter, err := ParseTraceFilter("", sc.Prefix, sc.Hop, "", "", "")
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		sink, err := OpenSink(conf, sc)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.sinks = append(s.sinks, newQueuedSink(sc.Type+":"+sc.Target, sink, filter, sc.Queue))
+	}
+	return s, nil
+}
+
+// add delivers traces matching filter to sink, from a queue of size traces.
+func (s *Sinks) add(name string, sink TraceSink, filter TraceFilter, size int) {
+	s.Lock()
+	defer s.Unlock()
+	s.sinks = append(s.sinks, newQueuedSink(name, sink, filter, size))
+}
+
+// Write offers a completed trace to every sink without waiting for delivery.
+func (s *Sinks) Write(t *traas2.Trace) {
+	s.Lock()
+	defer s.Unlock()
+	for _, q := range s.sinks {
+		q.offer(t)
+	}
+}
+
+// Reopen reopens the files of sinks backed by files.
+func (s *Sinks) Reopen() {
+	s.Lock()
+	defer s.Unlock()
+	for _, q := range s.sinks {
+		if tl, ok := q.sink.(*TraceLog); ok {
+			if err := tl.Reopen(); err != nil {
+				log.Printf("Could not reopen trace sink %s: %v\n", q.name, err)
+			}
+		}
+	}
+}
+
+// Close delivers queued traces and closes all sinks.
+func (s *Sinks) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	var firstErr error
+	for _, q := range s.sinks {
+		if err := q.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.sinks = nil
+	return firstErr
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package server
+
+import "errors"
+
+func openSyslogSink(conf Config, tag string) (TraceSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
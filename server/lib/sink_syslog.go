@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	"github.com/willscott/traas2"
+)
+
+// syslogSink writes trace records to the local syslog daemon.
+type syslogSink struct {
+	writer *syslog.Writer
+	conf   Config
+}
+
+func openSyslogSink(conf Config, tag string) (TraceSink, error) {
+	if tag == "" {
+		tag = "traas"
+	}
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w, conf}, nil
+}
+
+func (s *syslogSink) Write(t *traas2.Trace) error {
+	b, err := json.Marshal(NewTraceRecord(s.conf, t))
+	if err != nil {
+		return err
+	}
+	return s.writer.Info(string(b))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// blockingSink never finishes a write until released.
+type blockingSink struct {
+	release chan struct{}
+	written chan *traas2.Trace
+}
+
+func (b *blockingSink) Write(t *traas2.Trace) error {
+	<-b.release
+	b.written <- t
+	return nil
+}
+
+func (b *blockingSink) Close() error {
+	return nil
+}
+
+func TestSinkIsolation(t *testing.T) {
+	slow := &blockingSink{make(chan struct{}), make(chan *traas2.Trace, 8)}
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/8")
+	sinks := &Sinks{sinks: []*queuedSink{newQueuedSink("slow", slow, TraceFilter{Prefix: prefix}, 1)}}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4; i++ {
+			sinks.Write(&traas2.Trace{ID: "a", To: net.ParseIP("10.0.0.1")})
+		}
+		sinks.Write(&traas2.Trace{ID: "b", To: net.ParseIP("192.168.0.1")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Writing to sinks should not block on a slow sink")
+	}
+
+	close(slow.release)
+	sinks.Close()
+	if len(slow.written) == 0 || len(slow.written) > 2 {
+		t.Fatalf("Expected the queued traces to be delivered, got %d", len(slow.written))
+	}
+	for len(slow.written) > 0 {
+		if tr := <-slow.written; tr.ID != "a" {
+			t.Fatalf("Trace %s should have been filtered", tr.ID)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	attempts := 0
+	received := make(chan TraceRecord, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var record TraceRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		received <- record
+	}))
+	defer ts.Close()
+
+	sink, err := OpenSink(Config{ServerID: "test"}, SinkConfig{Type: "webhook", Target: ts.URL, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(&traas2.Trace{ID: "abc"}); err != nil {
+		t.Fatalf("Webhook should succeed on retry: %v", err)
+	}
+	if record := <-received; record.ID != "abc" || record.Server != "test" {
+		t.Fatalf("Unexpected record %+v", record)
+	}
+}
+
+func TestSinkCloseStopsRetries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	sink, err := OpenSink(Config{}, SinkConfig{Type: "webhook", Target: ts.URL, Retries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQueuedSink("webhook", sink, TraceFilter{}, 1)
+	q.offer(&traas2.Trace{ID: "abc"})
+
+	closed := make(chan struct{})
+	go func() {
+		q.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closing a sink should not wait out its retries")
+	}
+}
+
+func TestSocketSinkDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sink.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the socket is never read from, so a large enough write blocks.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		if conn := <-accepted; conn != nil {
+			conn.Close()
+		}
+	}()
+
+	sink := &socketSink{path: path, timeout: 100 * time.Millisecond}
+	defer sink.Close()
+	err = sink.Write(&traas2.Trace{ID: strings.Repeat("a", 16<<20)})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected socket writes to time out, got %v", err)
+	}
+}
@@ -3,50 +3,21 @@ package server
 import (
 	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/willscott/traas2"
 
 	"log"
 	"net"
 )
 
-var (
-	// TestSpoofChannel can be set, causing spoofed packets to go to it rather than a pcap
-	TestSpoofChannel chan []byte
-	handle           *pcap.Handle
-	ipv4Layer        layers.IPv4
-	linkHeader       []byte
-)
-
-// SetupSpoofingSockets opens a raw pcap socket for sending packets
-func SetupSpoofingSockets(config Config) error {
-	var err error
-
-	handle, err = pcap.OpenLive(config.Device, 2048, false, pcap.BlockForever)
-	if err != nil {
-		return err
-	}
-	// make sure the handle doesn't queue up packets and start blocking / dying
-	handle.SetBPFFilter("ip.len > 5000")
-
-	iface, err := net.InterfaceByName(config.Device)
-	if err != nil {
-		return err
-	}
-
-	dstBytes, _ := hex.DecodeString(config.Dst)
-	linkHeader = append(dstBytes, []byte(iface.HardwareAddr)...)
-	linkHeader = append(linkHeader, 0x08, 0) // IPv4 EtherType
+// probeInterval is the delay between successive probes of a trace.
+const probeInterval = 100 * time.Millisecond
 
-	//  var ipv6Layer layers.ipv6
-	//  ipv6Parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ipv6Layer)
-	return nil
-}
+// probeDuration is how long it takes SpoofProbe to send all probes of a trace.
+const probeDuration = probeInterval * (traas2.TraceLongestTTL - traas2.TraceShortestTTL)
 
 func getRecordRoute() []byte {
 	// per http://www.networksorcery.com/enp/protocol/ip/option007.htm
@@ -66,8 +37,8 @@ func getTimestamp() []byte {
 	return ts
 }
 
-// SpoofTCPMessage constructs and sends a tcp message sent in the same stream as 'request' with a specified payload.
-func SpoofTCPMessage(src net.IP, dest net.IP, request *layers.TCP, requestLength uint16, ttl byte, payload []byte, trace *traas2.Trace) error {
+// SpoofTCPMessage constructs and sends, with w, a tcp message sent in the same stream as 'request' with a specified payload.
+func SpoofTCPMessage(w PacketWriter, src net.IP, dest net.IP, request *layers.TCP, requestLength uint16, ttl byte, payload []byte) error {
 	// Send legit packet.
 	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{
@@ -114,29 +85,16 @@ func SpoofTCPMessage(src net.IP, dest net.IP, request *layers.TCP, requestLength
 	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
 		return err
 	}
-
-	if trace != nil {
-		trace.Hops[ttl-traas2.TraceShortestTTL].Sent = time.Now()
-	}
-	return SpoofIPv4Message(buf.Bytes())
-}
-
-// SpoofIPv4Message sends a serialized packet on the raw socket.
-func SpoofIPv4Message(packet []byte) error {
-	if TestSpoofChannel != nil {
-		TestSpoofChannel <- packet
-		return nil
-	}
-
-	if err := handle.WritePacketData(append(linkHeader, packet...)); err != nil {
+	if err := w.WritePacket(buf.Bytes()); err != nil {
 		log.Println("Couldn't send packet", err)
 		return err
 	}
 	return nil
 }
 
-// SpoofProbe will inject the message specified by probe in repsonse to a given TCP packet.
-func SpoofProbe(ctx context.Context, probe *traas2.Probe, inReplyTo gopacket.Packet, trace *traas2.Trace, withDelay bool) {
+// SpoofProbe will inject, with w, the message specified by probe in repsonse to a given TCP packet.
+// Probes are paced by clock, and sent, if not nil, is told when each TTL is probed.
+func SpoofProbe(ctx context.Context, w PacketWriter, clock Clock, probe *traas2.Probe, inReplyTo gopacket.Packet, sent func(ttl uint8, at time.Time), withDelay bool) {
 	ipFrame, ok := inReplyTo.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 	if !ok {
 		log.Printf("Asked to spoof but inReply had no ip frame")
@@ -154,11 +112,18 @@ func SpoofProbe(ctx context.Context, probe *traas2.Probe, inReplyTo gopacket.Pac
 		case <-ctx.Done():
 			return
 		default:
-			if err := SpoofTCPMessage(ipFrame.DstIP, ipFrame.SrcIP, tcpFrame, uint16(len(tcpFrame.Payload)), byte(i), probe.Payload, trace); err != nil {
+			if sent != nil {
+				sent(uint8(i), clock.Now())
+			}
+			if err := SpoofTCPMessage(w, ipFrame.DstIP, ipFrame.SrcIP, tcpFrame, uint16(len(tcpFrame.Payload)), byte(i), probe.Payload); err != nil {
 				log.Printf("Failed to send Pkt: %v\n", err)
 			}
 			if withDelay {
-				time.Sleep(100 * time.Millisecond)
+				select {
+				case <-clock.After(probeInterval):
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}
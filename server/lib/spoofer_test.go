@@ -5,6 +5,7 @@ import (
 	"context"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -13,9 +14,8 @@ import (
 
 func TestProbe(t *testing.T) {
 	// Send packets to channel, rather than socket.
-	TestSpoofChannel = make(chan []byte, (traas2.TraceLongestTTL-traas2.TraceShortestTTL)*2)
-
 	host := net.ParseIP("127.0.0.1")
+	conn := newChanConn(host, probedTTLs*2)
 
 	// Send legit packet.
 	payload := "hello world"
@@ -27,11 +27,11 @@ func TestProbe(t *testing.T) {
 		SrcPort: 8080,
 	}
 
-	err := SpoofTCPMessage(host, host, tcp, 512, 64, []byte(payload), nil)
+	err := SpoofTCPMessage(conn, host, host, tcp, 512, 64, []byte(payload))
 	if err != nil {
 		t.Fatalf("Failed to spoof msg: %v", err)
 	}
-	sentPkt := <-TestSpoofChannel
+	sentPkt := <-conn.sent
 	if !bytes.Contains(sentPkt, []byte(payload)) {
 		t.Fatal("Valid packet not spoofed")
 	}
@@ -46,11 +46,11 @@ func TestProbe(t *testing.T) {
 	serializer := gopacket.NewSerializeBuffer()
 	gopacket.SerializeLayers(serializer, gopacket.SerializeOptions{FixLengths: true}, ip, tcp)
 	pkt := gopacket.NewPacket(serializer.Bytes(), layers.LayerTypeIPv4, gopacket.DecodeOptions{})
-	SpoofProbe(context.Background(), &traas2.Probe{Payload: []byte(payload)}, pkt, nil, false)
+	SpoofProbe(context.Background(), conn, SystemClock, &traas2.Probe{Payload: []byte(payload)}, pkt, nil, false)
 
 	// Non-blocking read of the channel to see if an immediate packet was sent.
 	select {
-	case firstSend := <-TestSpoofChannel:
+	case firstSend := <-conn.sent:
 		if !bytes.Contains(firstSend, []byte(payload)) {
 			t.Fatal("Valid packet not spoofed")
 		}
@@ -58,3 +58,39 @@ func TestProbe(t *testing.T) {
 		t.Fatal("Some packet should be sent immediately from spoofprobe.")
 	}
 }
+
+func TestProbePacing(t *testing.T) {
+	ip := &layers.IPv4{Version: 4, Protocol: 6, SrcIP: net.IPv4(192, 168, 0, 1), DstIP: net.IPv4(192, 168, 0, 2)}
+	tcp := &layers.TCP{Ack: 1024, Seq: 512, ACK: true, DstPort: 80, SrcPort: 8080}
+	serializer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(serializer, gopacket.SerializeOptions{FixLengths: true}, ip, tcp)
+	pkt := gopacket.NewPacket(serializer.Bytes(), layers.LayerTypeIPv4, gopacket.DecodeOptions{})
+
+	conn := newChanConn(ip.SrcIP, traas2.TraceLongestTTL)
+	clock := newFakeClock()
+	start := clock.Now()
+	var sent [probedTTLs]time.Time
+	done := make(chan struct{})
+	go func() {
+		SpoofProbe(context.Background(), conn, clock, &traas2.Probe{}, pkt, func(ttl uint8, at time.Time) {
+			sent[ttl-traas2.TraceShortestTTL] = at
+		}, true)
+		close(done)
+	}()
+
+	for i := 0; i < probedTTLs; i++ {
+		<-conn.sent
+		clock.BlockUntil(1)
+		if len(conn.sent) != 0 {
+			t.Fatalf("Expected probe %d to wait, but more were sent", i)
+		}
+		if want := start.Add(time.Duration(i) * probeInterval); !sent[i].Equal(want) {
+			t.Fatalf("Expected probe %d to be sent at %v, got %v", i, want, sent[i])
+		}
+		clock.Advance(probeInterval)
+	}
+	<-done
+	if !clock.Now().Equal(start.Add(probeDuration)) {
+		t.Fatalf("Expected probing to take %v, took %v", probeDuration, clock.Now().Sub(start))
+	}
+}
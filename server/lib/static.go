@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/willscott/traas2"
+)
+
+// overlayFS serves files from a directory, falling back to a base filesystem
+// for any file the directory doesn't have.
+type overlayFS struct {
+	over fs.FS
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.over.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
+
+// demoFS is the demo site served by the server. The demo is embedded, and
+// files in a demo/ folder under conf.Root replace the embedded ones.
+func demoFS(conf Config) fs.FS {
+	demo := traas2.Demo()
+	if conf.Root == "" {
+		return demo
+	}
+	dir := filepath.Join(conf.Root, "demo")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Printf("No demo folder at %s, serving the embedded demo.\n", dir)
+		return demo
+	}
+	return overlayFS{over: os.DirFS(dir), base: demo}
+}
+
+// demoHandler serves the demo site.
+func demoHandler(conf Config) http.Handler {
+	return http.FileServer(http.FS(demoFS(conf)))
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDemoOverride(t *testing.T) {
+	root, err := ioutil.TempDir("", "traas-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Mkdir(filepath.Join(root, "demo"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "demo", "index.html"), []byte("custom"), 0600)
+
+	get := func(h http.Handler, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	h := demoHandler(Config{Root: root})
+	if code, body := get(h, "/"); code != http.StatusOK || body != "custom" {
+		t.Fatalf("Expected overridden index, got %d %q", code, body)
+	}
+	if code, _ := get(h, "/live.js"); code != http.StatusOK {
+		t.Fatalf("Expected embedded file without override, got %d", code)
+	}
+
+	h = demoHandler(Config{Root: filepath.Join(root, "missing")})
+	if code, body := get(h, "/"); code != http.StatusOK || body == "custom" {
+		t.Fatalf("Expected embedded index for missing root, got %d %q", code, body)
+	}
+}
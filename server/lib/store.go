@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// Store keeps completed traces for later retrieval.
+type Store interface {
+	// Put adds a completed trace.
+	Put(t *traas2.Trace) error
+	// Get returns the trace with a given id, or nil if it is not stored.
+	Get(id string) (*traas2.Trace, error)
+	// List returns traces matching a filter, most recent first.
+	List(filter TraceFilter) ([]*traas2.Trace, error)
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// TraceFilter selects stored traces.
+type TraceFilter struct {
+	Prefix *net.IPNet // Only traces to clients within prefix
+	HopIP  net.IP     // Only traces with a hop at HopIP
+	Since  time.Time  // Only traces started at or after Since
+	Until  time.Time  // Only traces started before Until
+	Limit  int        // At most Limit traces, if set
+}
+
+// MemoryStore keeps a bounded number of completed traces in memory.
+type MemoryStore struct {
+	sync.Mutex
+	size   int
+	ttl    time.Duration
+	clock  Clock
+	traces map[string]*traas2.Trace
+	// stored is when each trace was stored, which order follows.
+	stored map[string]time.Time
+	order  []string
+}
+
+// NewMemoryStore creates a store holding up to size traces, each for at most ttl, as told by clock.
+func NewMemoryStore(size int, ttl time.Duration, clock Clock) *MemoryStore {
+	return &MemoryStore{
+		size:   size,
+		ttl:    ttl,
+		clock:  clock,
+		traces: make(map[string]*traas2.Trace),
+		stored: make(map[string]time.Time),
+	}
+}
+
+// Put adds a completed trace to the store, evicting the earliest stored traces if full.
+// The trace is kept for the store ttl from now.
+func (s *MemoryStore) Put(t *traas2.Trace) error {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	if _, ok := s.traces[t.ID]; ok {
+		for i, id := range s.order {
+			if id == t.ID {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+	s.order = append(s.order, t.ID)
+	s.traces[t.ID] = t
+	s.stored[t.ID] = s.clock.Now()
+	for len(s.order) > s.size {
+		s.remove()
+	}
+	return nil
+}
+
+// Get returns the stored trace with a given id.
+func (s *MemoryStore) Get(id string) (*traas2.Trace, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	return s.traces[id], nil
+}
+
+// List returns stored traces matching filter, most recent first.
+func (s *MemoryStore) List(filter TraceFilter) ([]*traas2.Trace, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	matches := make([]*traas2.Trace, 0)
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if t := s.traces[s.order[i]]; filter.Match(t) {
+			matches = append(matches, t)
+		}
+	}
+	sortTraces(matches)
+	return filter.limit(matches), nil
+}
+
+// Close is a no-op for in-memory stores.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// expire removes traces stored longer ago than the store ttl. The lock must be held.
+func (s *MemoryStore) expire() {
+	cutoff := s.clock.Now().Add(-s.ttl)
+	for len(s.order) > 0 && s.stored[s.order[0]].Before(cutoff) {
+		s.remove()
+	}
+}
+
+// remove removes the earliest stored trace. The lock must be held.
+func (s *MemoryStore) remove() {
+	delete(s.traces, s.order[0])
+	delete(s.stored, s.order[0])
+	s.order = s.order[1:]
+}
+
+// sortTraces orders traces most recent first.
+func sortTraces(traces []*traas2.Trace) {
+	sort.SliceStable(traces, func(i, j int) bool {
+		return traces[i].Started.After(traces[j].Started)
+	})
+}
+
+// Match checks if a trace is selected by the filter.
+func (f TraceFilter) Match(t *traas2.Trace) bool {
+	if f.Prefix != nil && !f.Prefix.Contains(t.To) {
+		return false
+	}
+	if !f.Since.IsZero() && t.Started.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !t.Started.Before(f.Until) {
+		return false
+	}
+	if f.HopIP != nil {
+		for _, hop := range t.Route {
+			if hop.IP.Equal(f.HopIP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// limit truncates a list of matching traces to the filter limit.
+func (f TraceFilter) limit(traces []*traas2.Trace) []*traas2.Trace {
+	if f.Limit > 0 && len(traces) > f.Limit {
+		return traces[:f.Limit]
+	}
+	return traces
+}
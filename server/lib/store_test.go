@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+func fillStore(t *testing.T, store Store, now time.Time) {
+	traces := []*traas2.Trace{
+		{ID: "a", To: net.ParseIP("10.0.0.1"), Started: now.Add(-3 * time.Minute)},
+		{ID: "b", To: net.ParseIP("10.0.0.2"), Started: now.Add(-2 * time.Minute),
+			Route: traas2.Route{{TTL: 4, IP: net.ParseIP("172.16.0.1")}}},
+		{ID: "c", To: net.ParseIP("192.168.0.1"), Started: now.Add(-1 * time.Minute)},
+	}
+	for _, tr := range traces {
+		if err := store.Put(tr); err != nil {
+			t.Fatalf("Failed to store trace: %v", err)
+		}
+	}
+}
+
+func checkList(t *testing.T, store Store, filter TraceFilter, ids ...string) {
+	matches, err := store.List(filter)
+	if err != nil {
+		t.Fatalf("Failed to list traces: %v", err)
+	}
+	if len(matches) != len(ids) {
+		t.Fatalf("Expected %v, got %d traces", ids, len(matches))
+	}
+	for i, id := range ids {
+		if matches[i].ID != id {
+			t.Fatalf("Expected %v, got %s at %d", ids, matches[i].ID, i)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(2, time.Hour, SystemClock)
+	now := time.Now()
+	fillStore(t, store, now)
+
+	if tr, _ := store.Get("a"); tr != nil {
+		t.Fatal("Oldest trace should be evicted when the store is full")
+	}
+	if tr, _ := store.Get("b"); tr == nil || tr.ID != "b" {
+		t.Fatal("Stored trace should be retrievable by id")
+	}
+
+	checkList(t, store, TraceFilter{}, "c", "b")
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/8")
+	checkList(t, store, TraceFilter{Prefix: prefix}, "b")
+	checkList(t, store, TraceFilter{Since: now.Add(-90 * time.Second)}, "c")
+	checkList(t, store, TraceFilter{HopIP: net.ParseIP("172.16.0.1")}, "b")
+	checkList(t, store, TraceFilter{Limit: 1}, "c")
+
+	// Traces are kept from when they are stored, however long ago they started.
+	clock := newFakeClock()
+	expiring := NewMemoryStore(2, time.Minute, clock)
+	expiring.Put(&traas2.Trace{ID: "old", Started: clock.Now().Add(-time.Hour)})
+	clock.Advance(30 * time.Second)
+	expiring.Put(&traas2.Trace{ID: "new", Started: clock.Now().Add(-2 * time.Hour)})
+	if tr, _ := expiring.Get("old"); tr == nil {
+		t.Fatal("Traces should be kept for the ttl")
+	}
+	clock.Advance(45 * time.Second)
+	if tr, _ := expiring.Get("old"); tr != nil {
+		t.Fatal("Traces stored longer ago than the ttl should expire")
+	}
+	if tr, _ := expiring.Get("new"); tr == nil {
+		t.Fatal("Traces stored since should be kept")
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	store, err := OpenBoltStore(filepath.Join(dir, "traces.db"), 150*time.Second, clock, false)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+	now := clock.Now()
+	fillStore(t, store, now)
+
+	tr, err := store.Get("b")
+	if err != nil || tr == nil || !tr.To.Equal(net.ParseIP("10.0.0.2")) || len(tr.Route) != 1 {
+		t.Fatalf("Stored trace should be retrievable by id, got %v %v", tr, err)
+	}
+
+	checkList(t, store, TraceFilter{}, "c", "b", "a")
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/8")
+	checkList(t, store, TraceFilter{Prefix: prefix}, "b", "a")
+	_, prefix, _ = net.ParseCIDR("10.0.0.2/32")
+	checkList(t, store, TraceFilter{Prefix: prefix}, "b")
+	checkList(t, store, TraceFilter{Since: now.Add(-150 * time.Second), Until: now.Add(-30 * time.Second)}, "c", "b")
+	checkList(t, store, TraceFilter{HopIP: net.ParseIP("172.16.0.1")}, "b")
+	checkList(t, store, TraceFilter{HopIP: net.ParseIP("172.16.0.2")})
+
+	// Retention runs from when a trace was last stored, not when it started.
+	clock.Advance(time.Minute)
+	store.Put(tr)
+	store.Put(&traas2.Trace{ID: "d", To: net.ParseIP("10.0.0.4"), Started: now.Add(-time.Hour)})
+	clock.Advance(100 * time.Second)
+	if err := store.Prune(); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if tr, _ := store.Get("a"); tr != nil {
+		t.Fatal("Traces past retention should be pruned")
+	}
+	checkList(t, store, TraceFilter{Prefix: prefix}, "b")
+	checkList(t, store, TraceFilter{}, "b", "d")
+	checkList(t, store, TraceFilter{HopIP: net.ParseIP("172.16.0.1")}, "b")
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+// TraceSchemaVersion is the version of TraceRecord written to trace logs.
+// It is incremented whenever fields are changed or removed.
+const TraceSchemaVersion = 1
+
+// TraceRecord is a single line of a trace log.
+type TraceRecord struct {
+	Schema int           `json:"schema"`
+	ID     string        `json:"id"`
+	Server string        `json:"server"`
+	Logged time.Time     `json:"logged"`
+	Config ConfigRecord  `json:"config"`
+	Trace  *traas2.Trace `json:"trace"`
+}
+
+// ConfigRecord is the snapshot of server configuration included with logged traces.
+type ConfigRecord struct {
+	ServePort  uint16 `json:"servePort"`
+	ListenPort uint16 `json:"listenPort"`
+	Path       string `json:"path"`
+	Device     string `json:"device"`
+	IPHeader   string `json:"ipHeader,omitempty"`
+	Debug      bool   `json:"debug,omitempty"`
+}
+
+// NewTraceRecord describes a completed trace, and the server that recorded it.
+func NewTraceRecord(conf Config, t *traas2.Trace) TraceRecord {
+	return TraceRecord{
+		Schema: TraceSchemaVersion,
+		ID:     t.ID,
+		Server: conf.ServerID,
+		Logged: time.Now(),
+		Config: ConfigRecord{
+			ServePort:  conf.ServePort,
+			ListenPort: conf.ListenPort,
+			Path:       conf.Path,
+			Device:     conf.Device,
+			IPHeader:   conf.IPHeader,
+			Debug:      conf.Debug,
+		},
+		Trace: withoutPackets(t),
+	}
+}
+
+// TraceLog writes completed traces as JSON lines, rotating the file it writes to by size and age.
+type TraceLog struct {
+	sync.Mutex
+	path     string
+	out      io.Writer
+	file     *os.File
+	size     int64
+	opened   time.Time
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	conf     Config
+}
+
+// OpenTraceLog opens the trace log configured by conf. If conf.TraceFile is
+// unset, records are written to stderr and never rotated.
+func OpenTraceLog(conf Config) (*TraceLog, error) {
+	l := &TraceLog{
+		path:     conf.TraceFile,
+		out:      os.Stderr,
+		maxSize:  int64(conf.TraceMaxSize) * 1024 * 1024,
+		maxAge:   time.Duration(conf.TraceMaxAge) * time.Second,
+		compress: conf.TraceCompress,
+		conf:     conf,
+	}
+	if l.path == "" {
+		return l, nil
+	}
+	return l, l.open()
+}
+
+// open opens the log file for appending. The lock must be held.
+func (l *TraceLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.out = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// Write logs a completed trace.
+func (l *TraceLog) Write(t *traas2.Trace) error {
+	b, err := json.Marshal(NewTraceRecord(l.conf, t))
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	if l.file != nil && ((l.maxSize > 0 && l.size+int64(len(b)) > l.maxSize) ||
+		(l.maxAge > 0 && time.Since(l.opened) > l.maxAge)) {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate trace log: %v\n", err)
+		}
+	}
+	n, err := l.out.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// withoutPackets copies a trace, leaving out the captured packets of its route.
+func withoutPackets(t *traas2.Trace) *traas2.Trace {
+	copied := *t
+	copied.Route = make(traas2.Route, len(t.Route))
+	for i, hop := range t.Route {
+		hop.Packet = nil
+		copied.Route[i] = hop
+	}
+	return &copied
+}
+
+// rotate moves the current log file aside and opens a new one. The lock must be held.
+func (l *TraceLog) rotate() error {
+	rotated := l.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	// the moved file is written to until a new one is open.
+	err := l.reopen()
+	if l.compress && err == nil {
+		go compressFile(rotated)
+	}
+	return err
+}
+
+// reopen opens the log file, closing the previous one only once it has
+// replaced it. The lock must be held.
+func (l *TraceLog) reopen() error {
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// compressFile gzips a rotated log file, removing the original.
+func compressFile(path string) {
+	in, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to compress %s: %v\n", path, err)
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		log.Printf("Failed to compress %s: %v\n", path, err)
+		return
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Failed to compress %s: %v\n", path, err)
+		os.Remove(path + ".gz")
+		return
+	}
+	os.Remove(path)
+}
+
+// Reopen reopens the log file at its path. The previous file is kept if the
+// new one can't be opened.
+func (l *TraceLog) Reopen() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.reopen()
+}
+
+// Close closes the log file.
+func (l *TraceLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.out = ioutil.Discard
+	return err
+}
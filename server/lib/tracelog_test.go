@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+func TestTraceLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "traces.jsonl")
+	tl, err := OpenTraceLog(Config{TraceFile: path, TraceMaxSize: 1, ServerID: "test", ServePort: 8080})
+	if err != nil {
+		t.Fatalf("Failed to open trace log: %v", err)
+	}
+	defer tl.Close()
+
+	trace := &traas2.Trace{ID: "abc", To: net.ParseIP("10.0.0.1"), Started: time.Now()}
+	if err := tl.Write(trace); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("Expected a logged line")
+	}
+	var record TraceRecord
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatalf("Logged line should be plain JSON: %v", err)
+	}
+	f.Close()
+	if record.Schema != TraceSchemaVersion || record.ID != "abc" || record.Server != "test" || record.Config.ServePort != 8080 || len(record.Trace.Route) != 0 {
+		t.Fatalf("Unexpected record %+v", record)
+	}
+
+	// Exceed the 1MB max size to force rotation.
+	tl.size = tl.maxSize
+	if err := tl.Write(trace); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) != 1 {
+		t.Fatalf("Expected one rotated file, got %v", files)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Fatal("Expected a new trace log after rotation")
+	}
+}
+
+func TestTraceLogReopenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	tl, err := OpenTraceLog(Config{TraceFile: path})
+	if err != nil {
+		t.Fatalf("Failed to open trace log: %v", err)
+	}
+
+	// A directory in place of the moved log can't be reopened.
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Reopen(); err == nil {
+		t.Fatal("Expected reopening the log to fail")
+	}
+	trace := &traas2.Trace{ID: "abc", To: net.ParseIP("10.0.0.1"), Started: time.Now()}
+	if err := tl.Write(trace); err != nil {
+		t.Fatalf("Expected writes to go to the previous file, got %v", err)
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatalf("Expected the previous file to be closed once, got %v", err)
+	}
+}
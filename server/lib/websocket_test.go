@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/willscott/traas2"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example handshake from RFC 6455 section 1.3
+	if accept := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept key %s", accept)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	if !bytes.Equal(wsProbe.Payload, []byte{0x8A, 0x00}) {
+		t.Fatalf("Probe should be an empty pong, got %x", wsProbe.Payload)
+	}
+	if isWSClientFrame(wsProbe.Payload) {
+		t.Fatal("Unmasked server frames should not trigger probes")
+	}
+	if isWSClientFrame([]byte("GET /ws HTTP/1.1\r\n")) {
+		t.Fatal("HTTP requests should not trigger websocket probes")
+	}
+
+	// A masked "Hello" text frame, per RFC 6455 section 5.7
+	clientFrame := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	if !isWSClientFrame(clientFrame) {
+		t.Fatal("Client text frame should trigger probes")
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	conn := &wsConn{server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+	go client.Write(clientFrame)
+	op, payload, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	if op != wsOpText || string(payload) != "Hello" {
+		t.Fatalf("Unexpected frame %d %q", op, payload)
+	}
+
+	long := wsFrame(wsOpText, make([]byte, 300))
+	if long[1] != 126 || len(long) != 4+300 {
+		t.Fatal("Frames over 125 bytes should use a 16 bit length")
+	}
+}
+
+// readServerFrame reads an unmasked frame written by the server.
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(hdr[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0] & 0x0F, payload, err
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	s, rec, clock := newTestServer(t)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /traas/ws HTTP/1.1\r\nHost: traas\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	stream := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(stream, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the connection to upgrade, got %v: %v", resp, err)
+	}
+	tr := rec.GetTrace(net.ParseIP("127.0.0.1"))
+	if tr == nil || tr.Probe != wsProbe {
+		t.Fatal("Expected a websocket trace to begin")
+	}
+
+	// The first message of the client is answered by the probe.
+	conn.Write([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	if op, payload, err := readServerFrame(stream); err != nil || op != wsOpPong || len(payload) != 0 {
+		t.Fatalf("Expected the probe, got %d %q: %v", op, payload, err)
+	}
+
+	// Hops are streamed as they are received, then the trace is summarized.
+	rec.events.publish(traas2.Event{Type: traas2.EventHopReceived, ID: tr.ID, Hop: &traas2.Hop{TTL: 5}})
+	var msg wsMessage
+	if _, payload, err := readServerFrame(stream); err != nil || json.Unmarshal(payload, &msg) != nil || msg.Type != "hop" || msg.Hop.TTL != 5 {
+		t.Fatalf("Expected a hop, got %q: %v", payload, err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(probeDuration + collectDelay)
+	if _, payload, err := readServerFrame(stream); err != nil || json.Unmarshal(payload, &msg) != nil || msg.Type != "summary" || msg.Trace.ID != tr.ID {
+		t.Fatalf("Expected a summary, got %q: %v", payload, err)
+	}
+	if op, _, err := readServerFrame(stream); err != nil || op != wsOpClose {
+		t.Fatalf("Expected the connection to close, got %d: %v", op, err)
+	}
+	if stored, _ := s.store.Get(tr.ID); stored != tr {
+		t.Fatal("Expected the trace to be stored")
+	}
+}
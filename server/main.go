@@ -1,33 +1,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	server "github.com/willscott/traas2/server/lib"
 )
 
-var (
-	configFile   = flag.String("config", "", "File with server configuration")
-	initFlag     = flag.Bool("init", false, "if true, setup new configuration")
-	servePort    = flag.Int("port", 8080, "TCP port for web socket")
-	listenPort   = flag.Int("lport", 8080, "TCP port for incoming connection listening")
-	path         = flag.String("path", "", "prefix for web requests")
-	root         = flag.String("root", "..", "FS directory of traas for serving static files")
-	device       = flag.String("device", "eth0", "inet device for pcap to use")
-	dstMAC       = flag.String("dstMAC", "000000000000", "Ethernet DST for sending")
-	originHeader = flag.String("originHeader", "", "Client IPs are forwarded in a http header")
-	debug        = flag.Bool("debug", false, "track additional diagnostic information")
-	logFile      = flag.String("log", "", "where to log completed traces. If not set, will log to stdout")
-)
+// shutdownTimeout is how long requests may take to finish once the server is asked to stop.
+const shutdownTimeout = 15 * time.Second
+
+var configFile = flag.String("config", "", "File with server configuration. Default: $HOME/.config/traas.json")
+
+const usage = `Usage: %s [--config=file] <command> [flags]
+
+Commands:
+  serve   Run the server. This is the default command.
+  init    Write a new configuration, interactively or from flags.
+  check   Check the configuration, and that the server can run with it, then exit.
+  query   Print stored traces from the trace database.
+  replay  Rebuild the traces in a pcap capture.
+
+Run '%s <command> --help' for the flags of a command.
+
+Global flags:
+`
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if len(*configFile) == 0 {
@@ -36,62 +48,52 @@ func main() {
 			fmt.Fprintf(os.Stderr, "$HOME not set. Please either export $HOME or use an explict --config location.\n")
 			os.Exit(1)
 		}
-		configDir := filepath.Join(home, ".config")
-		if *initFlag {
-			os.Mkdir(configDir, 0700)
-		}
-		*configFile = filepath.Join(configDir, "traas.json")
+		*configFile = filepath.Join(home, ".config", "traas.json")
 	}
-	if *initFlag {
-		configHandle, err := os.OpenFile(*configFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
-			log.Fatalf("Failed to create config file: %s", err)
-			return
-		}
-		defaultConfig, _ := json.Marshal(server.Config{
-			ServePort:  uint16(*servePort),
-			ListenPort: uint16(*listenPort),
-			Path:       *path,
-			Root:       *root,
-			Device:     *device,
-			Dst:        *dstMAC,
-			TraceFile:  *logFile,
-		})
-		if _, err := configHandle.Write(defaultConfig); err != nil {
-			log.Fatalf("Failed to write default config: %s", err)
-			return
+
+	command, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+	}
+	if command == "init" {
+		if err := initConfig(*configFile, args); err != nil {
+			log.Fatalf("Init failed: %s", err)
 		}
-		configHandle.Close()
+		return
 	}
 
-	configString, err := ioutil.ReadFile(*configFile)
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Couldn't read config file: %s", err)
-		return
+		log.Fatalf("%s", err)
 	}
-
-	var config server.Config
-	if err = json.Unmarshal(configString, &config); err != nil {
-		log.Fatalf("Couldn't parse config: %s", err)
-		return
+	switch command {
+	case "serve":
+		err = serve(config, args)
+	case "check":
+		err = check(config, args)
+	case "query":
+		err = query(config, args)
+	case "replay":
+		err = replay(config, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", command, err)
+	}
+}
 
-	ll := log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmicroseconds)
-	if config.TraceFile != "" {
-		outfile, logerr := os.OpenFile(config.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if logerr != nil {
-			panic("could not open log file: " + logerr.Error())
-		}
-		ll = log.New(outfile, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+// loadConfig reads the configuration file, and fills in defaults for unset values.
+func loadConfig(file string) (server.Config, error) {
+	var config server.Config
+	configString, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, fmt.Errorf("Couldn't read config file (create one with the init command): %s", err)
 	}
-	if *logFile != "" {
-		outfile, logerr := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if logerr != nil {
-			panic("could not open log file: " + logerr.Error())
-		}
-		ll = log.New(outfile, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	if err = json.Unmarshal(configString, &config); err != nil {
+		return config, fmt.Errorf("Couldn't parse config: %s", err)
 	}
-	config.TraceLog = ll
 
 	if config.ServePort == 0 {
 		config.ServePort = 8080
@@ -100,21 +102,72 @@ func main() {
 		config.ListenPort = 8080
 	}
 	if config.Device == "" {
-		if iface, iferr := net.InterfaceByIndex(0); iferr == nil {
-			config.Device = iface.Name
-		} else {
-			config.Device = "eth0"
-		}
+		config.Device = "eth0"
+	}
+	if config.ServerID == "" {
+		config.ServerID, _ = os.Hostname()
 	}
+	return config, nil
+}
+
+// serve runs the server until it fails.
+func serve(config server.Config, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "track additional diagnostic information")
+	logFile := flags.String("log", "", "where to log completed traces, overriding TraceFile")
+	flags.Parse(args)
+
 	if *debug {
 		config.Debug = true
 	}
+	if *logFile != "" {
+		config.TraceFile = *logFile
+	}
+	traceLog, err := server.OpenTraceLog(config)
+	if err != nil {
+		return fmt.Errorf("Could not open trace log: %s", err)
+	}
+	config.TraceLog = traceLog
 
-	fmt.Printf("Using config %+v \n", config)
-	if err = server.SetupSpoofingSockets(config); err != nil {
-		log.Fatalf("Could not initialize sockets: %s", err)
-		return
+	shown := config
+	if shown.APIToken != "" {
+		shown.APIToken = "<redacted>"
 	}
+	fmt.Printf("Using config %+v \n", shown)
 	s := server.NewServer(config)
-	s.Serve()
+	if s == nil {
+		return fmt.Errorf("Could not initialize server")
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.Reopen()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+	select {
+	case err = <-served:
+		s.Close()
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down\n", sig)
+		// A second signal stops waiting for requests to finish.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		return s.Shutdown(ctx)
+	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	server "github.com/willscott/traas2/server/lib"
+)
+
+// query prints stored traces matching the filter in args, one JSON trace per line.
+func query(config server.Config, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	ip := flags.String("ip", "", "only traces to this client IP")
+	prefix := flags.String("prefix", "", "only traces to clients in this CIDR prefix")
+	hop := flags.String("hop", "", "only traces with a hop at this IP")
+	since := flags.String("since", "", "only traces started at or after this RFC 3339 time")
+	until := flags.String("until", "", "only traces started before this RFC 3339 time")
+	limit := flags.String("limit", "", "at most this many traces")
+	flags.Parse(args)
+
+	if config.Database == "" {
+		return errors.New("no Database is configured")
+	}
+	filter, err := server.ParseTraceFilter(*ip, *prefix, *hop, *since, *until, *limit)
+	if err != nil {
+		return err
+	}
+	store, err := server.OpenBoltStore(config.Database, time.Duration(config.StoreTTL)*time.Second, server.SystemClock, true)
+	if err != nil {
+		return fmt.Errorf("could not open %s (if the server is running, use its /traces API instead): %v", config.Database, err)
+	}
+	defer store.Close()
+
+	traces, err := store.List(filter)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, t := range traces {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
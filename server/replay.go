@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	server "github.com/willscott/traas2/server/lib"
+)
+
+// replay prints the traces rebuilt from a pcap capture, as tables or one JSON trace per line.
+func replay(config server.Config, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	jsonFlag := flags.Bool("json", false, "print traces as JSON rather than tables")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: replay [--json] <capture.pcap>")
+	}
+
+	traces, err := server.Replay(config, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for i, t := range traces {
+		if *jsonFlag {
+			err = enc.Encode(t)
+		} else {
+			if i > 0 {
+				os.Stdout.Write([]byte("\n"))
+			}
+			err = t.WriteText(os.Stdout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
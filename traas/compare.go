@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/willscott/traas2"
+)
+
+// hopsByTTL collects the responding IPs of a trace at each TTL.
+func hopsByTTL(t *traas2.Trace) map[uint8][]net.IP {
+	hops := make(map[uint8][]net.IP)
+	for _, hop := range t.Route {
+		seen := false
+		for _, ip := range hops[hop.TTL] {
+			seen = seen || ip.Equal(hop.IP)
+		}
+		if !seen {
+			hops[hop.TTL] = append(hops[hop.TTL], hop.IP)
+		}
+	}
+	return hops
+}
+
+// sameHops checks if two TTLs were answered by the same set of IPs.
+func sameHops(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ip := range a {
+		found := false
+		for _, other := range b {
+			found = found || ip.Equal(other)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// formatHops lists the IPs of a TTL, or '*' if there were none.
+func formatHops(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "*"
+	}
+	s := ips[0].String()
+	for _, ip := range ips[1:] {
+		s += " " + ip.String()
+	}
+	return s
+}
+
+// writeComparison writes the TTLs at which current was answered differently than previous.
+func writeComparison(w io.Writer, previous, current *traas2.Trace) error {
+	before, after := hopsByTTL(previous), hopsByTTL(current)
+	changed := 0
+	for ttl := traas2.TraceShortestTTL; ttl <= traas2.TraceLongestTTL; ttl++ {
+		was, is := before[uint8(ttl)], after[uint8(ttl)]
+		if sameHops(was, is) {
+			continue
+		}
+		if changed == 0 {
+			if _, err := fmt.Fprintf(w, "changes since trace %s (%s):\n", previous.ID, previous.Started.Format("2006-01-02 15:04:05")); err != nil {
+				return err
+			}
+		}
+		changed++
+		if _, err := fmt.Fprintf(w, "%2d  %s -> %s\n", ttl, formatHops(was), formatHops(is)); err != nil {
+			return err
+		}
+	}
+	if changed == 0 {
+		_, err := fmt.Fprintf(w, "route unchanged since trace %s\n", previous.ID)
+		return err
+	}
+	return nil
+}
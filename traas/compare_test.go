@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/willscott/traas2"
+)
+
+func route(hops map[uint8]string) traas2.Route {
+	var r traas2.Route
+	for ttl := uint8(traas2.TraceShortestTTL); ttl <= traas2.TraceLongestTTL; ttl++ {
+		if ip, ok := hops[ttl]; ok {
+			r = append(r, traas2.Hop{TTL: ttl, IP: net.ParseIP(ip)})
+		}
+	}
+	return r
+}
+
+func TestSameHops(t *testing.T) {
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	for _, c := range []struct {
+		was, is []net.IP
+		same    bool
+	}{
+		{nil, nil, true},
+		{[]net.IP{a, b}, []net.IP{b, a}, true},
+		{[]net.IP{a}, nil, false},
+		{[]net.IP{a}, []net.IP{b}, false},
+		{[]net.IP{a}, []net.IP{a, b}, false},
+	} {
+		if got := sameHops(c.was, c.is); got != c.same {
+			t.Fatalf("Expected %v and %v to be same: %v, got %v", c.was, c.is, c.same, got)
+		}
+	}
+}
+
+func TestHopsByTTL(t *testing.T) {
+	trace := &traas2.Trace{Route: traas2.Route{
+		{TTL: 4, IP: net.ParseIP("10.0.0.1")},
+		{TTL: 4, IP: net.ParseIP("10.0.0.1")},
+		{TTL: 4, IP: net.ParseIP("10.0.0.2")},
+		{TTL: 5, IP: net.ParseIP("10.0.0.3")},
+	}}
+	hops := hopsByTTL(trace)
+	if len(hops) != 2 || len(hops[4]) != 2 || len(hops[5]) != 1 {
+		t.Fatalf("Expected the distinct IPs of each TTL, got %v", hops)
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	previous := &traas2.Trace{
+		ID:      "abc",
+		Started: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Route:   route(map[uint8]string{4: "10.0.0.1", 5: "10.0.0.2", 6: "10.0.0.3"}),
+	}
+	for _, c := range []struct {
+		name string
+		hops map[uint8]string
+		want string
+	}{
+		{"unchanged", map[uint8]string{4: "10.0.0.1", 5: "10.0.0.2", 6: "10.0.0.3"},
+			"route unchanged since trace abc\n"},
+		{"added", map[uint8]string{4: "10.0.0.1", 5: "10.0.0.2", 6: "10.0.0.3", 7: "10.0.0.4"},
+			"changes since trace abc (2020-01-02 03:04:05):\n 7  * -> 10.0.0.4\n"},
+		{"removed", map[uint8]string{4: "10.0.0.1", 6: "10.0.0.3"},
+			"changes since trace abc (2020-01-02 03:04:05):\n 5  10.0.0.2 -> *\n"},
+		{"changed", map[uint8]string{4: "10.0.0.9", 5: "10.0.0.2", 6: "10.0.0.8"},
+			"changes since trace abc (2020-01-02 03:04:05):\n 4  10.0.0.1 -> 10.0.0.9\n 6  10.0.0.3 -> 10.0.0.8\n"},
+	} {
+		var out bytes.Buffer
+		if err := writeComparison(&out, previous, &traas2.Trace{Route: route(c.hops)}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != c.want {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.want, out.String())
+		}
+	}
+}
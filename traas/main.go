@@ -0,0 +1,136 @@
+// Command traas runs reverse traceroutes against a traas server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/willscott/traas2"
+	"github.com/willscott/traas2/client"
+)
+
+var (
+	jsonFlag = flag.Bool("json", false, "print traces as JSON rather than a table")
+	count    = flag.Int("count", 1, "how many traces to run")
+	interval = flag.Duration("interval", 10*time.Second, "delay between repeated traces")
+	timeout  = flag.Duration("timeout", 30*time.Second, "how long a single trace may take")
+	proxy    = flag.String("proxy", "", "URL of an HTTP proxy to trace through")
+	compare  = flag.String("compare", "", "JSON trace file of a previous result to compare with")
+	save     = flag.String("save", "", "file to save the last trace to as JSON")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <server url>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  e.g. %s http://example.com/traas\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var previous *traas2.Trace
+	if *compare != "" {
+		var err error
+		if previous, err = readTrace(*compare); err != nil {
+			log.Fatalf("Could not read previous trace: %s", err)
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// probes are HTTP/1.1 responses, so HTTP/2 is not negotiated.
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+	if *proxy != "" {
+		proxyURL, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatalf("Invalid proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	c, err := client.New(flag.Arg(0), &http.Client{Transport: transport})
+	if err != nil {
+		log.Fatalf("Invalid server: %s", err)
+	}
+
+	failed := false
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		t, err := run(c)
+		if err != nil {
+			log.Printf("Trace failed: %s", err)
+			failed = true
+			continue
+		}
+		if err := printTrace(t, previous); err != nil {
+			log.Fatalf("Could not print trace: %s", err)
+		}
+		if *save != "" {
+			if err := writeTrace(*save, t); err != nil {
+				log.Fatalf("Could not save trace: %s", err)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// run runs a single trace, bounded by the timeout.
+func run(c *client.Client) (*traas2.Trace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return c.Trace(ctx)
+}
+
+// printTrace writes a trace to stdout, as JSON or as a table, followed by its
+// differences from a previous trace if one is given.
+func printTrace(t, previous *traas2.Trace) error {
+	if *jsonFlag {
+		if err := json.NewEncoder(os.Stdout).Encode(t); err != nil {
+			return err
+		}
+	} else if err := t.WriteText(os.Stdout); err != nil {
+		return err
+	}
+	if previous != nil {
+		return writeComparison(os.Stdout, previous, t)
+	}
+	return nil
+}
+
+// readTrace reads a trace saved as JSON.
+func readTrace(file string) (*traas2.Trace, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t := new(traas2.Trace)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// writeTrace saves a trace as JSON.
+func writeTrace(file string, t *traas2.Trace) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
@@ -0,0 +1,545 @@
+package traas2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Warts is the binary format of the scamper measurement tool. Traces are
+// written as traceroute objects, preceded by the list and cycle objects
+// they belong to, so they can be read by scamper's sc_ analysis tools.
+// See the warts(5) manual page of scamper for the format.
+
+// wartsMagic begins every warts object.
+const wartsMagic = 0x1205
+
+// wartsMaxObject is the longest object read, well above any traceroute.
+const wartsMaxObject = 1 << 20
+
+// Warts object types
+const (
+	wartsTypeList       = 0x0001
+	wartsTypeCycleStart = 0x0002
+	wartsTypeCycleStop  = 0x0004
+	wartsTypeTrace      = 0x0006
+)
+
+// Warts traceroute parameters, numbered by their flag
+const (
+	wartsTraceListID    = 1
+	wartsTraceCycleID   = 2
+	wartsTraceStart     = 5
+	wartsTraceStopR     = 6
+	wartsTraceAttempts  = 9
+	wartsTraceHopLimit  = 10
+	wartsTraceType      = 11
+	wartsTraceFirstHop  = 15
+	wartsTraceHopCount  = 19
+	wartsTraceProbeC    = 23
+	wartsTraceAddrSrc   = 26
+	wartsTraceAddrDst   = 27
+	wartsTraceAddrRtr   = 30
+	wartsTraceParamsMax = 30
+)
+
+// Warts traceroute hop parameters, numbered by their flag
+const (
+	wartsHopProbeTTL  = 2
+	wartsHopReplyTTL  = 3
+	wartsHopFlags     = 4
+	wartsHopRTT       = 6
+	wartsHopICMPTC    = 7
+	wartsHopICMPExt   = 17
+	wartsHopAddr      = 18
+	wartsHopParamsMax = 19
+)
+
+// wartsTraceParamSizes are the sizes of fixed size traceroute parameters by flag.
+// Variable sized parameters are marked -1.
+var wartsTraceParamSizes = [wartsTraceParamsMax + 1]int{
+	0, 4, 4, 4, 4, 8, 1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 2, 1, 1, 1, 2, 1, 1, -1, -1, 4, 2, -1,
+}
+
+// wartsHopParamSizes are the sizes of fixed size hop parameters by flag.
+var wartsHopParamSizes = [wartsHopParamsMax + 1]int{
+	0, 4, 1, 1, 1, 1, 4, 2, 2, 2, 2, 1, 2, 2, 1, 1, 1, -1, -1, 8,
+}
+
+// Values of warts traceroute fields
+const (
+	wartsTraceTypeTCP       = 0x03
+	wartsStopNone           = 0x00
+	wartsStopCompleted      = 0x01
+	wartsHopFlagReplyTTL    = 0x10
+	wartsAddrIPv4           = 0x01
+	wartsAddrIPv6           = 0x02
+	wartsListID             = 1
+	wartsCycleID            = 1
+	wartsListName           = "traas"
+	wartsTraceMaxHopRecords = 0xFFFF
+)
+
+// SourceWarts is the Source of traces imported from warts files.
+const SourceWarts = "warts"
+
+// wartsParams accumulates the flags and values of a warts parameter block.
+type wartsParams struct {
+	flags  []byte
+	values bytes.Buffer
+}
+
+// set marks parameter flag as present. Parameters must be set in increasing flag order.
+func (p *wartsParams) set(flag int) *bytes.Buffer {
+	for len(p.flags) <= (flag-1)/7 {
+		p.flags = append(p.flags, 0)
+	}
+	p.flags[(flag-1)/7] |= 1 << uint((flag-1)%7)
+	return &p.values
+}
+
+func (p *wartsParams) u8(flag int, v uint8) {
+	p.set(flag).WriteByte(v)
+}
+
+func (p *wartsParams) u16(flag int, v uint16) {
+	binary.Write(p.set(flag), binary.BigEndian, v)
+}
+
+func (p *wartsParams) u32(flag int, v uint32) {
+	binary.Write(p.set(flag), binary.BigEndian, v)
+}
+
+func (p *wartsParams) timeval(flag int, t time.Time) {
+	buf := p.set(flag)
+	binary.Write(buf, binary.BigEndian, uint32(t.Unix()))
+	binary.Write(buf, binary.BigEndian, uint32(t.Nanosecond()/1000))
+}
+
+func (p *wartsParams) addr(flag int, ip net.IP) {
+	buf := p.set(flag)
+	if v4 := ip.To4(); v4 != nil {
+		buf.Write([]byte{net.IPv4len, wartsAddrIPv4})
+		buf.Write(v4)
+	} else {
+		buf.Write([]byte{net.IPv6len, wartsAddrIPv6})
+		buf.Write(ip.To16())
+	}
+}
+
+// bytes serializes the parameter block. A block without parameters is a single zero byte.
+func (p *wartsParams) bytes() []byte {
+	if len(p.flags) == 0 {
+		return []byte{0}
+	}
+	out := make([]byte, 0, len(p.flags)+2+p.values.Len())
+	for i, f := range p.flags {
+		if i < len(p.flags)-1 {
+			f |= 0x80
+		}
+		out = append(out, f)
+	}
+	out = append(out, byte(p.values.Len()>>8), byte(p.values.Len()))
+	return append(out, p.values.Bytes()...)
+}
+
+// writeWartsObject writes an object with its header.
+func writeWartsObject(w io.Writer, objType uint16, body []byte) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:2], wartsMagic)
+	binary.BigEndian.PutUint16(hdr[2:4], objType)
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(len(body)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// WriteWarts writes traces as a warts file, in a single list and cycle.
+func WriteWarts(w io.Writer, traces []*Trace) error {
+	start := time.Now()
+	stop := time.Time{}
+	for _, t := range traces {
+		if t.Started.Before(start) {
+			start = t.Started
+		}
+		if t.Started.After(stop) {
+			stop = t.Started
+		}
+	}
+
+	var list bytes.Buffer
+	binary.Write(&list, binary.BigEndian, uint32(wartsListID))
+	binary.Write(&list, binary.BigEndian, uint32(wartsListID))
+	list.WriteString(wartsListName)
+	list.WriteByte(0)
+	list.WriteByte(0)
+	if err := writeWartsObject(w, wartsTypeList, list.Bytes()); err != nil {
+		return err
+	}
+
+	var cycle bytes.Buffer
+	binary.Write(&cycle, binary.BigEndian, uint32(wartsCycleID))
+	binary.Write(&cycle, binary.BigEndian, uint32(wartsListID))
+	binary.Write(&cycle, binary.BigEndian, uint32(wartsCycleID))
+	binary.Write(&cycle, binary.BigEndian, uint32(start.Unix()))
+	cycle.WriteByte(0)
+	if err := writeWartsObject(w, wartsTypeCycleStart, cycle.Bytes()); err != nil {
+		return err
+	}
+
+	for _, t := range traces {
+		if err := writeWartsObject(w, wartsTypeTrace, t.wartsTrace()); err != nil {
+			return err
+		}
+	}
+
+	cycle.Reset()
+	binary.Write(&cycle, binary.BigEndian, uint32(wartsCycleID))
+	binary.Write(&cycle, binary.BigEndian, uint32(stop.Unix()))
+	cycle.WriteByte(0)
+	return writeWartsObject(w, wartsTypeCycleStop, cycle.Bytes())
+}
+
+// wartsTrace serializes a trace as the body of a warts traceroute object.
+func (t *Trace) wartsTrace() []byte {
+	var last uint8
+	if len(t.Route) > 0 {
+		last = t.Route[len(t.Route)-1].TTL
+	}
+	stop := uint8(wartsStopNone)
+	if t.Reached {
+		stop = wartsStopCompleted
+	}
+
+	var p wartsParams
+	p.u32(wartsTraceListID, wartsListID)
+	p.u32(wartsTraceCycleID, wartsCycleID)
+	p.timeval(wartsTraceStart, t.Started)
+	p.u8(wartsTraceStopR, stop)
+	p.u8(wartsTraceAttempts, 1)
+	p.u8(wartsTraceHopLimit, TraceLongestTTL)
+	p.u8(wartsTraceType, wartsTraceTypeTCP)
+	p.u8(wartsTraceFirstHop, TraceShortestTTL)
+	p.u16(wartsTraceHopCount, uint16(last))
+	p.u16(wartsTraceProbeC, uint16(len(t.Route)))
+	if t.From != nil {
+		p.addr(wartsTraceAddrSrc, t.From)
+	}
+	if t.To != nil {
+		p.addr(wartsTraceAddrDst, t.To)
+	}
+	body := p.bytes()
+
+	hops := t.Route
+	if len(hops) > wartsTraceMaxHopRecords {
+		hops = hops[:wartsTraceMaxHopRecords]
+	}
+	body = append(body, byte(len(hops)>>8), byte(len(hops)))
+	for _, hop := range hops {
+		body = append(body, hop.wartsHop()...)
+	}
+	// no optional attributes follow the hops.
+	return append(body, 0, 0)
+}
+
+// wartsHop serializes a hop as a warts traceroute hop record.
+func (h Hop) wartsHop() []byte {
+	var flags uint8
+	if h.ReplyTTL != 0 {
+		flags |= wartsHopFlagReplyTTL
+	}
+	var p wartsParams
+	p.u8(wartsHopProbeTTL, h.TTL)
+	if h.ReplyTTL != 0 {
+		p.u8(wartsHopReplyTTL, h.ReplyTTL)
+	}
+	p.u8(wartsHopFlags, flags)
+	p.u32(wartsHopRTT, uint32(h.RTT()/time.Microsecond))
+	p.u16(wartsHopICMPTC, uint16(h.ICMPType)<<8|uint16(h.ICMPCode))
+	if len(h.Extensions) > 0 {
+		var ext bytes.Buffer
+		for _, e := range h.Extensions {
+			data := e.Data
+			if e.MPLS != nil {
+				data = nil
+				for _, l := range e.MPLS {
+					entry := l.Label<<12 | uint32(l.Exp&0x7)<<9 | uint32(l.TTL)
+					if l.S {
+						entry |= 0x100
+					}
+					data = append(data, byte(entry>>24), byte(entry>>16), byte(entry>>8), byte(entry))
+				}
+			}
+			binary.Write(&ext, binary.BigEndian, uint16(len(data)))
+			ext.Write([]byte{e.Class, e.Type})
+			ext.Write(data)
+		}
+		buf := p.set(wartsHopICMPExt)
+		binary.Write(buf, binary.BigEndian, uint16(ext.Len()))
+		buf.Write(ext.Bytes())
+	}
+	if h.IP != nil {
+		p.addr(wartsHopAddr, h.IP)
+	}
+	return p.bytes()
+}
+
+// errWartsTruncated is returned for objects shorter than their contents.
+var errWartsTruncated = errors.New("truncated warts object")
+
+// errWartsOverrun is returned for parameters longer than their block.
+var errWartsOverrun = errors.New("warts parameters overrun their block")
+
+// wartsReader decodes fields of a warts object.
+type wartsReader struct {
+	buf   []byte
+	addrs []net.IP
+	err   error
+}
+
+func (r *wartsReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = errWartsTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wartsReader) u8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *wartsReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *wartsReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *wartsReader) timeval() time.Time {
+	sec := r.u32()
+	usec := r.u32()
+	return time.Unix(int64(sec), int64(usec)*1000)
+}
+
+// addr reads an embedded address, or a reference to one earlier in the object.
+func (r *wartsReader) addr() net.IP {
+	length := r.u8()
+	if length == 0 {
+		id := r.u32()
+		if int(id) >= len(r.addrs) {
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown warts address %d", id)
+			}
+			return nil
+		}
+		return r.addrs[id]
+	}
+	addrType := r.u8()
+	b := r.next(int(length))
+	if b == nil {
+		return nil
+	}
+	var ip net.IP
+	if addrType == wartsAddrIPv4 || addrType == wartsAddrIPv6 {
+		ip = append(net.IP(nil), b...)
+	}
+	r.addrs = append(r.addrs, ip)
+	return ip
+}
+
+// params reads the flags of a parameter block, and the length of its values.
+func (r *wartsReader) params() ([]bool, int) {
+	var flags []bool
+	for {
+		f := r.u8()
+		if r.err != nil {
+			return nil, 0
+		}
+		for i := uint(0); i < 7; i++ {
+			flags = append(flags, f&(1<<i) != 0)
+		}
+		if f&0x80 == 0 {
+			break
+		}
+	}
+	for _, set := range flags {
+		if set {
+			return append([]bool{false}, flags...), int(r.u16())
+		}
+	}
+	return nil, 0
+}
+
+// skipParams moves past the values of a parameter block that weren't
+// decoded, given how much of the object remained after its flags.
+func (r *wartsReader) skipParams(remaining, length int) {
+	read := remaining - len(r.buf)
+	if r.err == nil && read > length {
+		r.err = errWartsOverrun
+		return
+	}
+	r.next(length - read)
+}
+
+// ReadWarts reads the traceroute objects of a warts file as traces.
+// Other objects are skipped.
+func ReadWarts(in io.Reader) ([]*Trace, error) {
+	br := bufio.NewReader(in)
+	traces := make([]*Trace, 0)
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, hdr); err == io.EOF {
+			return traces, nil
+		} else if err != nil {
+			return traces, err
+		}
+		if binary.BigEndian.Uint16(hdr[0:2]) != wartsMagic {
+			return traces, errors.New("not a warts file")
+		}
+		length := binary.BigEndian.Uint32(hdr[4:8])
+		if length > wartsMaxObject {
+			return traces, fmt.Errorf("warts object of %d bytes is too long", length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return traces, err
+		}
+		if binary.BigEndian.Uint16(hdr[2:4]) != wartsTypeTrace {
+			continue
+		}
+		t, err := readWartsTrace(body)
+		if err != nil {
+			return traces, err
+		}
+		traces = append(traces, t)
+	}
+}
+
+// readWartsTrace decodes the body of a warts traceroute object.
+func readWartsTrace(body []byte) (*Trace, error) {
+	r := &wartsReader{buf: body}
+	t := &Trace{Source: SourceWarts}
+	flags, length := r.params()
+	remaining := len(r.buf)
+params:
+	for flag := 1; flag < len(flags); flag++ {
+		if !flags[flag] {
+			continue
+		}
+		switch {
+		case flag == wartsTraceStart:
+			t.Started = r.timeval()
+		case flag == wartsTraceStopR:
+			t.Reached = r.u8() == wartsStopCompleted
+		case flag == wartsTraceAddrSrc:
+			t.From = r.addr()
+		case flag == wartsTraceAddrDst:
+			t.To = r.addr()
+		case flag == wartsTraceAddrRtr:
+			r.addr()
+		case flag <= wartsTraceParamsMax && wartsTraceParamSizes[flag] > 0:
+			r.next(wartsTraceParamSizes[flag])
+		default:
+			// newer parameters are skipped by the length of the block.
+			break params
+		}
+	}
+	r.skipParams(remaining, length)
+
+	count := int(r.u16())
+	for i := 0; i < count && r.err == nil; i++ {
+		hop, err := r.hop()
+		if err != nil {
+			return nil, err
+		}
+		t.Route = append(t.Route, hop)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return t, nil
+}
+
+// hop decodes a warts traceroute hop record.
+func (r *wartsReader) hop() (Hop, error) {
+	var h Hop
+	flags, length := r.params()
+	remaining := len(r.buf)
+params:
+	for flag := 1; flag < len(flags); flag++ {
+		if !flags[flag] {
+			continue
+		}
+		switch {
+		case flag == wartsHopProbeTTL:
+			h.TTL = r.u8()
+		case flag == wartsHopReplyTTL:
+			h.ReplyTTL = r.u8()
+		case flag == wartsHopRTT:
+			h.Latency = time.Duration(r.u32()) * time.Microsecond / 2
+		case flag == wartsHopICMPTC:
+			tc := r.u16()
+			h.ICMPType = uint8(tc >> 8)
+			h.ICMPCode = uint8(tc)
+		case flag == wartsHopICMPExt:
+			h.Extensions = r.icmpExtensions()
+		case flag == wartsHopAddr:
+			h.IP = r.addr()
+		case flag <= wartsHopParamsMax && wartsHopParamSizes[flag] > 0:
+			r.next(wartsHopParamSizes[flag])
+		default:
+			break params
+		}
+	}
+	r.skipParams(remaining, length)
+	return h, r.err
+}
+
+// icmpExtensions decodes the ICMP extensions of a hop.
+func (r *wartsReader) icmpExtensions() []ICMPExtension {
+	ext := &wartsReader{buf: r.next(int(r.u16()))}
+	var objects []ICMPExtension
+	for len(ext.buf) > 0 && ext.err == nil {
+		length := int(ext.u16())
+		obj := ICMPExtension{Class: ext.u8(), Type: ext.u8()}
+		data := ext.next(length)
+		if obj.Class == ICMPExtensionClassMPLS && obj.Type == 1 {
+			for ; len(data) >= 4; data = data[4:] {
+				entry := binary.BigEndian.Uint32(data)
+				obj.MPLS = append(obj.MPLS, MPLSLabel{
+					Label: entry >> 12,
+					Exp:   uint8(entry>>9) & 0x7,
+					S:     entry&0x100 != 0,
+					TTL:   uint8(entry),
+				})
+			}
+		} else {
+			obj.Data = append([]byte(nil), data...)
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
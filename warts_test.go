@@ -0,0 +1,135 @@
+package traas2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWartsRoundTrip(t *testing.T) {
+	start := time.Unix(1500000000, 250000000)
+	trace := &Trace{
+		ID:      "abc",
+		From:    net.ParseIP("192.0.2.1"),
+		To:      net.ParseIP("10.0.0.1"),
+		Started: start,
+		Reached: true,
+		Route: Route{
+			{TTL: 4, IP: net.ParseIP("192.168.0.1"), Latency: time.Millisecond, ICMPType: 11, ReplyTTL: 252,
+				Extensions: []ICMPExtension{{Class: 1, Type: 1, MPLS: []MPLSLabel{{Label: 16000, Exp: 2, S: true, TTL: 1}}}}},
+			{TTL: 6, IP: net.ParseIP("10.0.0.1"), Latency: 1500 * time.Microsecond, ICMPType: 3, ICMPCode: 13},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteWarts(&buf, []*Trace{trace, trace}); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(buf.Bytes()) != wartsMagic {
+		t.Fatal("Expected warts magic")
+	}
+
+	traces, err := ReadWarts(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("Expected 2 traces, got %d", len(traces))
+	}
+	got := traces[0]
+	if got.Source != SourceWarts || !got.From.Equal(trace.From) || !got.To.Equal(trace.To) ||
+		!got.Started.Equal(start) || !got.Reached || len(got.Route) != 2 {
+		t.Fatalf("Unexpected trace %+v", got)
+	}
+	first := got.Route[0]
+	if first.TTL != 4 || !first.IP.Equal(trace.Route[0].IP) || first.Latency != time.Millisecond ||
+		first.ICMPType != 11 || first.ReplyTTL != 252 {
+		t.Fatalf("Unexpected hop %+v", first)
+	}
+	if len(first.Extensions) != 1 || first.Extensions[0].MPLS[0] != trace.Route[0].Extensions[0].MPLS[0] {
+		t.Fatalf("Unexpected extensions %+v", first.Extensions)
+	}
+	if second := got.Route[1]; second.ICMPType != 3 || second.ICMPCode != 13 || second.Latency != 1500*time.Microsecond {
+		t.Fatalf("Unexpected hop %+v", second)
+	}
+}
+
+func TestReadWartsScamper(t *testing.T) {
+	// A hop record as scamper writes it: probe size, reply size and ip id
+	// parameters, and an address referring to the trace's destination.
+	var hop wartsParams
+	hop.u8(wartsHopProbeTTL, 5)
+	hop.u16(8, 60)
+	hop.u16(9, 56)
+	hop.u16(10, 1234)
+	buf := hop.set(wartsHopAddr)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, uint32(1))
+
+	var p wartsParams
+	p.u32(wartsTraceListID, 7)
+	p.u16(12, 44)
+	p.u16(13, 33434)
+	p.addr(wartsTraceAddrSrc, net.ParseIP("2001:db8::1"))
+	p.addr(wartsTraceAddrDst, net.ParseIP("2001:db8::2"))
+	body := append(p.bytes(), 0, 1)
+	body = append(body, hop.bytes()...)
+	body = append(body, 0, 0)
+
+	var file bytes.Buffer
+	writeWartsObject(&file, wartsTypeList, []byte{0, 0, 0, 1, 0, 0, 0, 7, 'x', 0, 0})
+	writeWartsObject(&file, wartsTypeTrace, body)
+	traces, err := ReadWarts(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || len(traces[0].Route) != 1 {
+		t.Fatalf("Expected a trace with one hop, got %+v", traces)
+	}
+	if h := traces[0].Route[0]; h.TTL != 5 || !h.IP.Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("Unexpected hop %+v", h)
+	}
+
+	if _, err := ReadWarts(bytes.NewReader([]byte{0x12, 0x05, 0, 6, 0, 0, 0, 9, 1})); err == nil {
+		t.Fatal("Expected truncated object to fail")
+	}
+	if _, err := ReadWarts(bytes.NewReader([]byte{0x12, 0x05, 0, 6, 0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Fatal("Expected overlong object to fail")
+	}
+}
+
+func TestReadWartsNewerParams(t *testing.T) {
+	// Parameters of newer scamper versions follow those that are known.
+	var hop wartsParams
+	hop.u8(wartsHopProbeTTL, 5)
+	hop.u32(wartsHopParamsMax+1, 1)
+	hop.u16(wartsHopParamsMax+3, 2)
+
+	var p wartsParams
+	p.addr(wartsTraceAddrDst, net.ParseIP("10.0.0.1"))
+	p.u8(wartsTraceParamsMax+1, 1)
+	body := append(p.bytes(), 0, 1)
+	body = append(body, hop.bytes()...)
+
+	traces, err := ReadWarts(bytes.NewReader(wartsObject(wartsTypeTrace, body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || !traces[0].To.Equal(net.ParseIP("10.0.0.1")) || len(traces[0].Route) != 1 || traces[0].Route[0].TTL != 5 {
+		t.Fatalf("Expected the known parameters to be read, got %+v", traces)
+	}
+
+	// A block shorter than its known parameters is corrupt.
+	overrun := p.bytes()
+	overrun[len(p.flags)+1] = 2
+	if _, err := ReadWarts(bytes.NewReader(wartsObject(wartsTypeTrace, append(overrun, 0, 0)))); err == nil {
+		t.Fatal("Expected parameters overrunning their block to fail")
+	}
+}
+
+func wartsObject(objType uint16, body []byte) []byte {
+	var file bytes.Buffer
+	writeWartsObject(&file, objType, body)
+	return file.Bytes()
+}